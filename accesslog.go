@@ -0,0 +1,65 @@
+package frogproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (proxy *ProxyHttpServer) EnableAccessLog(w io.Writer) {
+	proxy.accessLog = &accessLogger{w: w}
+}
+
+func (proxy *ProxyHttpServer) logAccess(req *http.Request, status int, size int64, start time.Time) {
+	if req == nil {
+		return
+	}
+	if proxy.hostStats != nil {
+		proxy.hostStats.record(req, size)
+	}
+	if proxy.accessLog != nil {
+		proxy.accessLog.write(req, status, size, start)
+	}
+}
+
+func (l *accessLogger) write(req *http.Request, status int, size int64, start time.Time) {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || client == "" {
+		client = "-"
+	}
+	target := req.Host
+	if req.Method != http.MethodConnect && req.URL != nil {
+		target = req.URL.String()
+	}
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.FormatInt(size, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s %q %q %d\n",
+		client,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method, target, req.Proto,
+		status, bytes,
+		orDash(req.Referer()), orDash(req.UserAgent()),
+		time.Since(start).Microseconds())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
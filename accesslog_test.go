@@ -0,0 +1,95 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+var accessLine = regexp.MustCompile(`^(\S+) - - \[[^\]]+\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-) "[^"]*" "[^"]*" \d+$`)
+
+// accessEntry is the method, target and status of an access log line.
+type accessEntry struct {
+	method, target, status string
+}
+
+func parseAccessLog(t *testing.T, log string) []accessEntry {
+	t.Helper()
+	var entries []accessEntry
+	for _, line := range strings.Split(strings.TrimSuffix(log, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		m := accessLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed access log line %q", line)
+		}
+		entries = append(entries, accessEntry{m[2], m[3], m[5]})
+	}
+	return entries
+}
+
+func TestAccessLogCoversEveryReply(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer up.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	upHost := strings.TrimPrefix(up.URL, "http://")
+	for _, tc := range []struct {
+		name string
+		send func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server)
+		want accessEntry
+	}{
+		{"proxied", func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server) {
+			get(t, proxyClient(t, p), up.URL+"/ok")
+		}, accessEntry{"GET", up.URL + "/ok", "200"}},
+		{"max forwards", func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server) {
+			req, _ := http.NewRequest("OPTIONS", up.URL+"/mf", nil)
+			req.Header.Set("Max-Forwards", "0")
+			resp, err := proxyClient(t, p).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}, accessEntry{"OPTIONS", up.URL + "/mf", "200"}},
+		{"paused", func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server) {
+			p.Pause()
+			get(t, proxyClient(t, p), up.URL+"/paused")
+		}, accessEntry{"GET", up.URL + "/paused", "503"}},
+		{"rejected connect", func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server) {
+			p.OnRequest().HandleConnect(frogproxy.AlwaysReject)
+			connectThrough(t, ps.URL, upHost)
+		}, accessEntry{"CONNECT", upHost, "403"}},
+		{"unreachable connect", func(t *testing.T, p *frogproxy.ProxyHttpServer, ps *httptest.Server) {
+			connectThrough(t, ps.URL, deadAddr)
+		}, accessEntry{"CONNECT", deadAddr, "502"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			p := frogproxy.NewProxyHttpServer()
+			p.EnableAccessLog(logs)
+			ps := httptest.NewServer(p)
+			defer ps.Close()
+
+			tc.send(t, p, ps)
+			eventually(t, func() bool { return logs.String() != "" }, "no access log line written")
+			entries := parseAccessLog(t, logs.String())
+			if len(entries) != 1 || entries[0] != tc.want {
+				t.Errorf("access log %+v, want [%+v]", entries, tc.want)
+			}
+		})
+	}
+}
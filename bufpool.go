@@ -0,0 +1,25 @@
+package frogproxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+var bufioReaderPool sync.Pool
+
+// newBufioReader reuses a pooled reader of the same size when one is
+// available, avoiding a fresh buffer for every MITM connection.
+func newBufioReader(r io.Reader, size int) *bufio.Reader {
+	if br, ok := bufioReaderPool.Get().(*bufio.Reader); ok && br.Size() == size {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+// putBufioReader returns br to the pool. br must not be used afterwards.
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
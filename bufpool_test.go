@@ -0,0 +1,46 @@
+package frogproxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestBufioReaderPool(t *testing.T) {
+	br := newBufioReader(strings.NewReader("first\nleftover"), 64)
+	if line, _ := br.ReadString('\n'); line != "first\n" {
+		t.Fatalf("got %q", line)
+	}
+	putBufioReader(br)
+
+	// A reused reader must not see data buffered for the previous conn.
+	br = newBufioReader(strings.NewReader("second\n"), 64)
+	if line, _ := br.ReadString('\n'); line != "second\n" {
+		t.Fatalf("got %q", line)
+	}
+	putBufioReader(br)
+
+	if br := newBufioReader(strings.NewReader(""), 128); br.Size() != 128 {
+		t.Fatalf("got a reader of size %d, want 128", br.Size())
+	}
+}
+
+func BenchmarkBufioReaderChurn(b *testing.B) {
+	const size = 8194
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			br := bufio.NewReaderSize(strings.NewReader(request), size)
+			br.ReadString('\n')
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			br := newBufioReader(strings.NewReader(request), size)
+			br.ReadString('\n')
+			putBufioReader(br)
+		}
+	})
+}
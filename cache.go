@@ -0,0 +1,237 @@
+package frogproxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultStaleCacheMaxBodySize int64 = 1 << 20
+
+var DefaultStaleCacheMaxEntries = 1024
+
+type staleEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	vary   []string
+	varied []string
+	elem   *list.Element
+}
+
+// StaleCache keeps recent successful GET responses and serves them, with a
+// Warning header, when the upstream round trip fails within Window of the
+// response being stored. Entries are dropped once Window has passed, and
+// the oldest entries are evicted first when more than MaxEntries are held.
+type StaleCache struct {
+	Window      time.Duration
+	MaxBodySize int64
+	MaxEntries  int
+	mu          sync.Mutex
+	entries     map[string][]*staleEntry
+	order       list.List
+}
+
+func NewStaleCache(window time.Duration) *StaleCache {
+	return &StaleCache{
+		Window:      window,
+		MaxBodySize: DefaultStaleCacheMaxBodySize,
+		MaxEntries:  DefaultStaleCacheMaxEntries,
+		entries:     make(map[string][]*staleEntry),
+	}
+}
+
+func (c *StaleCache) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	req := ctx.Req
+	if req == nil || req.Method != http.MethodGet || hasCredentials(req) {
+		return resp
+	}
+	key := req.URL.String()
+	if resp == nil {
+		if ctx.Error == nil {
+			return resp
+		}
+		return c.serveStale(key, req, ctx)
+	}
+	if resp.StatusCode == http.StatusOK && storable(resp) && resp.ContentLength <= c.MaxBodySize {
+		c.capture(key, req, resp, ctx)
+	}
+	return resp
+}
+
+// hasCredentials reports whether req carries credentials, in which case
+// the response may be specific to that user and is neither stored nor
+// served from the cache.
+func hasCredentials(req *http.Request) bool {
+	return req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != ""
+}
+
+func storable(resp *http.Response) bool {
+	if hasCacheDirective(resp.Header, "no-store") || hasCacheDirective(resp.Header, "private") {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+func hasCacheDirective(h http.Header, directive string) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func variedValues(req *http.Request, vary []string) []string {
+	values := make([]string, len(vary))
+	for i, name := range vary {
+		values[i] = strings.Join(req.Header.Values(name), ",")
+	}
+	return values
+}
+
+func (e *staleEntry) matches(req *http.Request) bool {
+	for i, v := range variedValues(req, e.vary) {
+		if v != e.varied[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// staleCapture copies a response body as it streams to the client and
+// stores it once it has been read in full, unless it outgrows max.
+type staleCapture struct {
+	io.ReadCloser
+	buf    bytes.Buffer
+	max    int64
+	length int64
+	done   bool
+	store  func(body []byte)
+}
+
+func (sc *staleCapture) Read(p []byte) (int, error) {
+	n, err := sc.ReadCloser.Read(p)
+	if sc.done {
+		return n, err
+	}
+	if int64(sc.buf.Len()+n) > sc.max || err != nil && err != io.EOF {
+		sc.done = true
+		sc.buf = bytes.Buffer{}
+		return n, err
+	}
+	sc.buf.Write(p[:n])
+	if err == io.EOF || sc.length >= 0 && int64(sc.buf.Len()) == sc.length {
+		sc.done = true
+		sc.store(sc.buf.Bytes())
+	}
+	return n, err
+}
+
+func (c *StaleCache) capture(key string, req *http.Request, resp *http.Response, ctx *ProxyCtx) {
+	vary := varyHeaders(resp.Header)
+	entry := &staleEntry{key: key, status: resp.StatusCode, header: resp.Header.Clone(), vary: vary, varied: variedValues(req, vary)}
+	ctx.PassThroughBody(resp, &staleCapture{
+		ReadCloser: resp.Body,
+		max:        c.MaxBodySize,
+		length:     resp.ContentLength,
+		store: func(body []byte) {
+			entry.body = body
+			c.store(entry, req)
+		},
+	})
+}
+
+func (c *StaleCache) store(entry *staleEntry, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.stored = time.Now()
+	for _, e := range c.entries[entry.key] {
+		if e.matches(req) {
+			c.removeLocked(e)
+			break
+		}
+	}
+	c.entries[entry.key] = append(c.entries[entry.key], entry)
+	entry.elem = c.order.PushFront(entry)
+	c.evictLocked(entry.stored)
+}
+
+// evictLocked drops entries whose stale window has ended, then the oldest
+// entries beyond MaxEntries.
+func (c *StaleCache) evictLocked(now time.Time) {
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultStaleCacheMaxEntries
+	}
+	for elem := c.order.Back(); elem != nil; elem = c.order.Back() {
+		entry := elem.Value.(*staleEntry)
+		if c.order.Len() <= max && now.Sub(entry.stored) <= c.Window {
+			return
+		}
+		c.removeLocked(entry)
+	}
+}
+
+func (c *StaleCache) removeLocked(entry *staleEntry) {
+	c.order.Remove(entry.elem)
+	variants := c.entries[entry.key]
+	for i, e := range variants {
+		if e == entry {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, entry.key)
+	} else {
+		c.entries[entry.key] = variants
+	}
+}
+
+func (c *StaleCache) serveStale(key string, req *http.Request, ctx *ProxyCtx) *http.Response {
+	c.mu.Lock()
+	c.evictLocked(time.Now())
+	var entry *staleEntry
+	for _, e := range c.entries[key] {
+		if e.matches(req) {
+			entry = e
+			break
+		}
+	}
+	c.mu.Unlock()
+	if entry == nil {
+		return nil
+	}
+	ctx.Logf("Upstream failed (%v), serving stale response for %v", ctx.Error, key)
+	resp := NewResponse(req, "", entry.status, string(entry.body))
+	resp.Header = entry.header.Clone()
+	resp.Header.Add("Warning", `111 - "Revalidation Failed"`)
+	return resp
+}
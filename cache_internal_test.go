@@ -0,0 +1,25 @@
+package frogproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleCacheDropsExpiredEntries(t *testing.T) {
+	c := NewStaleCache(10 * time.Millisecond)
+	store := func(u string) {
+		req, _ := http.NewRequest("GET", u, nil)
+		c.store(&staleEntry{key: u, status: http.StatusOK, header: http.Header{}}, req)
+	}
+	store("http://example.com/a")
+	store("http://example.com/b")
+	time.Sleep(20 * time.Millisecond)
+	store("http://example.com/c")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) != 1 || c.order.Len() != 1 || c.entries["http://example.com/c"] == nil {
+		t.Fatalf("expired entries kept: %d keys, %d entries", len(c.entries), c.order.Len())
+	}
+}
@@ -0,0 +1,182 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// flakyServer answers with the given headers until down is set, after
+// which it drops every connection without a response.
+func flakyServer(t *testing.T, header http.Header) (*httptest.Server, *atomic.Bool) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		io.WriteString(w, "fresh "+r.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &down
+}
+
+func staleGet(t *testing.T, c *http.Client, u string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", u, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestStaleCacheServesStaleOnError(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().Do(frogproxy.NewStaleCache(time.Minute))
+	c := proxyClient(t, p)
+	up, down := flakyServer(t, nil)
+
+	if _, body := get(t, c, up.URL); body != "fresh " {
+		t.Fatalf("got %q", body)
+	}
+	down.Store(true)
+	resp, body := get(t, c, up.URL)
+	if resp.StatusCode != http.StatusOK || body != "fresh " {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Warning") != `111 - "Revalidation Failed"` {
+		t.Fatalf("Warning = %q", resp.Header.Get("Warning"))
+	}
+}
+
+func TestStaleCacheExpiredEntry(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().Do(frogproxy.NewStaleCache(10 * time.Millisecond))
+	c := proxyClient(t, p)
+	up, down := flakyServer(t, nil)
+
+	get(t, c, up.URL)
+	time.Sleep(20 * time.Millisecond)
+	down.Store(true)
+	if resp, _ := get(t, c, up.URL); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expired entry served: %d", resp.StatusCode)
+	}
+}
+
+func TestStaleCacheSkipsUncacheable(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   http.Header
+		req    http.Header
+		stored bool
+	}{
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, no-store"}}, nil, false},
+		{"private", http.Header{"Cache-Control": {"Private"}}, nil, false},
+		{"vary star", http.Header{"Vary": {"*"}}, nil, false},
+		{"authorization", nil, http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, false},
+		{"cookie", nil, http.Header{"Cookie": {"session=1"}}, false},
+		{"public", http.Header{"Cache-Control": {"public, max-age=60"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := frogproxy.NewProxyHttpServer()
+			p.OnResponse().Do(frogproxy.NewStaleCache(time.Minute))
+			c := proxyClient(t, p)
+			up, down := flakyServer(t, tt.resp)
+
+			staleGet(t, c, up.URL, tt.req)
+			down.Store(true)
+			resp, _ := staleGet(t, c, up.URL, tt.req)
+			if stored := resp.StatusCode == http.StatusOK; stored != tt.stored {
+				t.Fatalf("served from cache = %v, want %v", stored, tt.stored)
+			}
+		})
+	}
+}
+
+func TestStaleCacheHonorsVary(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().Do(frogproxy.NewStaleCache(time.Minute))
+	c := proxyClient(t, p)
+	up, down := flakyServer(t, http.Header{"Vary": {"Accept-Language"}})
+	en := http.Header{"Accept-Language": {"en"}}
+	fr := http.Header{"Accept-Language": {"fr"}}
+
+	staleGet(t, c, up.URL, en)
+	staleGet(t, c, up.URL, fr)
+	down.Store(true)
+	for _, h := range []http.Header{en, fr} {
+		resp, body := staleGet(t, c, up.URL, h)
+		if want := "fresh " + h.Get("Accept-Language"); resp.StatusCode != http.StatusOK || body != want {
+			t.Fatalf("got %d %q, want %q", resp.StatusCode, body, want)
+		}
+	}
+	if resp, body := staleGet(t, c, up.URL, http.Header{"Accept-Language": {"de"}}); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("served another variant: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestStaleCacheEvictsOldest(t *testing.T) {
+	cache := frogproxy.NewStaleCache(time.Minute)
+	cache.MaxEntries = 2
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().Do(cache)
+	c := proxyClient(t, p)
+	up, down := flakyServer(t, nil)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		get(t, c, up.URL+path)
+	}
+	down.Store(true)
+	if resp, _ := get(t, c, up.URL+"/a"); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("/a: got %d, want it evicted", resp.StatusCode)
+	}
+	for _, path := range []string{"/b", "/c"} {
+		if resp, _ := get(t, c, up.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d, want a stale hit", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestStaleCacheStreamsBodies(t *testing.T) {
+	// Large enough to get past the proxy's response buffering.
+	first := strings.Repeat("x", 64<<10)
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, " second")
+	}))
+	defer up.Close()
+	defer close(release)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().Do(frogproxy.NewStaleCache(time.Minute))
+	resp, err := proxyClient(t, p).Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The first chunk arrives while the upstream is still holding the rest.
+	buf := make([]byte, len(first))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != first {
+		t.Fatalf("first chunk not delivered: %v", err)
+	}
+}
@@ -1,8 +1,17 @@
 package frogproxy
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 func init() {
@@ -15,6 +24,93 @@ func init() {
 	}
 }
 
+// LoadCAFromPEM parses a PEM encoded CA certificate and private key into a
+// certificate suitable for SetMitmCa.
+func LoadCAFromPEM(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	return ca, nil
+}
+
+// GenerateCA creates a new self-signed CA that can sign the per host
+// certificates used for MITM. The returned PEM blocks can be passed to
+// LoadCAFromPEM.
+func GenerateCA(commonName string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"FrogProxy untrusted MITM proxy Inc"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+// SaveCA generates a CA valid for ten years and writes it to ca.pem and
+// ca.key in dir. Existing files are never overwritten, so a CA that is
+// already trusted is not replaced by accident, and a failure never leaves
+// one file of the pair behind without the other.
+func SaveCA(dir string) (tls.Certificate, error) {
+	keyFile, certFile := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.pem")
+	for _, name := range []string{keyFile, certFile} {
+		if _, err := os.Lstat(name); err == nil {
+			return tls.Certificate{}, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+		}
+	}
+	certPEM, keyPEM, err := GenerateCA("FrogProxy CA", 10*365*24*time.Hour)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeNewFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeNewFile(certFile, certPEM, 0644); err != nil {
+		os.Remove(keyFile)
+		return tls.Certificate{}, err
+	}
+	return LoadCAFromPEM(certPEM, keyPEM)
+}
+
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
 var defaultTLSConfig = &tls.Config{
 	InsecureSkipVerify: true,
 }
@@ -0,0 +1,276 @@
+package frogproxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func newCA(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM, err := frogproxy.GenerateCA(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := frogproxy.LoadCAFromPEM(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestSetMitmCaReplacesCachedLeaves(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.CertStore = frogproxy.LRUCertStore(16)
+	p.SetMitmCa(newCA(t, "first CA"))
+	c, up := mitmClient(t, p)
+
+	var mu sync.Mutex
+	var issuer string
+	tr := c.Transport.(*http.Transport)
+	tr.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		mu.Lock()
+		issuer = cs.PeerCertificates[0].Issuer.CommonName
+		mu.Unlock()
+		return nil
+	}
+	issuedBy := func() string {
+		tr.CloseIdleConnections()
+		get(t, c, up.URL)
+		mu.Lock()
+		defer mu.Unlock()
+		return issuer
+	}
+
+	if got := issuedBy(); got != "first CA" {
+		t.Fatalf("leaf issued by %q, want first CA", got)
+	}
+	p.SetMitmCa(newCA(t, "second CA"))
+	if got := issuedBy(); got != "second CA" {
+		t.Fatalf("leaf issued by %q after SetMitmCa, want second CA", got)
+	}
+	// The deprecated name still works.
+	p.SetCA(newCA(t, "third CA"))
+	if got := issuedBy(); got != "third CA" {
+		t.Fatalf("leaf issued by %q after SetCA, want third CA", got)
+	}
+}
+
+func TestCARotationLeavesOpenTunnels(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.SetMitmCa(newCA(t, "old CA"))
+	c, up := mitmClient(t, p)
+
+	var mu sync.Mutex
+	var issuers []string
+	tr := c.Transport.(*http.Transport)
+	tr.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		mu.Lock()
+		issuers = append(issuers, cs.PeerCertificates[0].Issuer.CommonName)
+		mu.Unlock()
+		return nil
+	}
+	handshakes := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), issuers...)
+	}
+
+	get(t, c, up.URL)
+	p.SetMitmCa(newCA(t, "new CA"))
+	// The open tunnel keeps serving requests without a new handshake.
+	if _, body := get(t, c, up.URL); body != "hello world" {
+		t.Fatalf("open tunnel after rotation: got %q", body)
+	}
+	if got := handshakes(); len(got) != 1 || got[0] != "old CA" {
+		t.Fatalf("handshakes before reconnecting: %v", got)
+	}
+	tr.CloseIdleConnections()
+	get(t, c, up.URL)
+	if got := handshakes(); len(got) != 2 || got[1] != "new CA" {
+		t.Fatalf("handshakes after reconnecting: %v", got)
+	}
+}
+
+func TestSaveCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := frogproxy.SaveCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Certificate[0], ca.Certificate[0]) {
+		t.Error("saved certificate differs from the returned CA")
+	}
+	if _, err := frogproxy.SaveCA(dir); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("second SaveCA: got %v, want ErrExist", err)
+	}
+}
+
+func TestSaveCALeavesNoHalfPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(certFile, []byte("trusted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := frogproxy.SaveCA(dir); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("got %v, want ErrExist", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ca.key")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ca.key written next to an existing ca.pem: %v", err)
+	}
+	if b, _ := os.ReadFile(certFile); string(b) != "trusted" {
+		t.Errorf("existing ca.pem overwritten: %q", b)
+	}
+}
+
+func TestMitmCertChain(t *testing.T) {
+	ca := newCA(t, "chain CA")
+	for _, tt := range []struct {
+		host     string
+		wildcard bool
+		name     string
+	}{
+		{"example.com:443", false, "example.com"},
+		{"example.com", false, "example.com"},
+		{"api.example.com:8443", true, "api.example.com"},
+		{"192.0.2.7:443", false, "192.0.2.7"},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.SetMitmCa(ca)
+		p.WildcardCerts = tt.wildcard
+		p.CertStore = frogproxy.LRUCertStore(16)
+		chain, err := p.MitmCertChain(tt.host)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		if len(chain) != 2 {
+			t.Fatalf("%s: chain of %d certificates, want leaf and CA", tt.host, len(chain))
+		}
+		leaf, issuer := chain[0], chain[1]
+		if err := leaf.VerifyHostname(tt.name); err != nil {
+			t.Errorf("%s: leaf not valid for the host: %v", tt.host, err)
+		}
+		if tt.wildcard && (len(leaf.DNSNames) == 0 || leaf.DNSNames[0] != "*.example.com") {
+			t.Errorf("%s: leaf names %v, want a wildcard", tt.host, leaf.DNSNames)
+		}
+		if !bytes.Equal(issuer.Raw, ca.Certificate[0]) || leaf.CheckSignatureFrom(issuer) != nil {
+			t.Errorf("%s: second certificate is not the signing CA", tt.host)
+		}
+
+		// A client connecting to the host is shown the same chain.
+		ps := httptest.NewServer(p)
+		p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+		raw, _ := connectThrough(t, ps.URL, tt.host)
+		conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		presented := conn.ConnectionState().PeerCertificates
+		if len(presented) != 2 || !presented[0].Equal(leaf) || !presented[1].Equal(issuer) {
+			t.Errorf("%s: client was presented a different chain", tt.host)
+		}
+		conn.Close()
+		ps.Close()
+	}
+}
+
+// recordingCertStore caches certificates by key and records each key it
+// had to generate a certificate for.
+type recordingCertStore struct {
+	mu        sync.Mutex
+	certs     map[string]*tls.Certificate
+	generated []string
+}
+
+func (s *recordingCertStore) Fetch(key string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cert, ok := s.certs[key]; ok {
+		return cert, nil
+	}
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	if s.certs == nil {
+		s.certs = make(map[string]*tls.Certificate)
+	}
+	s.certs[key] = cert
+	s.generated = append(s.generated, key)
+	return cert, nil
+}
+
+func TestWildcardCerts(t *testing.T) {
+	hosts := []string{"a.example.com", "b.example.com", "example.com", "a.b.example.com", "192.0.2.7"}
+	for _, tt := range []struct {
+		wildcard  bool
+		generated []string
+		names     []string
+	}{
+		{false, hosts, hosts},
+		// a. and b.example.com share one certificate.
+		{true, []string{"*.example.com", "example.com", "*.b.example.com", "192.0.2.7"},
+			[]string{"*.example.com", "*.example.com", "example.com", "*.b.example.com", "192.0.2.7"}},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.WildcardCerts = tt.wildcard
+		store := &recordingCertStore{}
+		p.CertStore = store
+		p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+		ps := httptest.NewServer(p)
+
+		var leaves []*x509.Certificate
+		for i, host := range hosts {
+			raw, _ := connectThrough(t, ps.URL, host+":443")
+			conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, ServerName: host})
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("%s: %v", host, err)
+			}
+			leaf := conn.ConnectionState().PeerCertificates[0]
+			conn.Close()
+			if err := leaf.VerifyHostname(host); err != nil {
+				t.Errorf("wildcard=%v: %v", tt.wildcard, err)
+			}
+			if name := leafName(leaf); name != tt.names[i] {
+				t.Errorf("wildcard=%v: %s got a certificate for %s, want %s", tt.wildcard, host, name, tt.names[i])
+			}
+			leaves = append(leaves, leaf)
+		}
+		ps.Close()
+
+		if shared := leaves[0].Equal(leaves[1]); shared != tt.wildcard {
+			t.Errorf("wildcard=%v: a. and b.example.com share a certificate = %v", tt.wildcard, shared)
+		}
+		if !reflect.DeepEqual(store.generated, tt.generated) {
+			t.Errorf("wildcard=%v: generated %v, want %v", tt.wildcard, store.generated, tt.generated)
+		}
+	}
+}
+
+func leafName(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.IPAddresses) > 0 {
+		return cert.IPAddresses[0].String()
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,66 @@
+package frogproxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+type lruCertEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+type lruCertStore struct {
+	max     int
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// LRUCertStore returns a CertStorage keeping at most maxEntries host
+// certificates, evicting the least recently used one when full.
+func LRUCertStore(maxEntries int) CertStorage {
+	return &lruCertStore{
+		max:     maxEntries,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *lruCertStore) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.mu.Lock()
+	if e, ok := s.entries[hostname]; ok {
+		s.order.MoveToFront(e)
+		cert := e.Value.(*lruCertEntry).cert
+		s.mu.Unlock()
+		return cert, nil
+	}
+	s.mu.Unlock()
+
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[hostname]; ok {
+		s.order.MoveToFront(e)
+		return e.Value.(*lruCertEntry).cert, nil
+	}
+	s.entries[hostname] = s.order.PushFront(&lruCertEntry{hostname, cert})
+	for s.max > 0 && s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruCertEntry).host)
+	}
+	return cert, nil
+}
+
+func (s *lruCertStore) Flush() {
+	s.mu.Lock()
+	s.order.Init()
+	s.entries = make(map[string]*list.Element)
+	s.mu.Unlock()
+}
@@ -0,0 +1,91 @@
+package frogproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// clientWatcher cancels a MITM request's context when the client goes away.
+// Once the request body has been read it peeks at the client connection in
+// the background; an error there means the client disconnected. Any bytes
+// that arrive instead stay buffered for the next request.
+type clientWatcher struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	done    chan struct{}
+}
+
+func newClientWatcher(conn net.Conn, r *bufio.Reader, cancel context.CancelFunc) *clientWatcher {
+	return &clientWatcher{conn: conn, r: r, cancel: cancel}
+}
+
+func (w *clientWatcher) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started || w.stopped {
+		return
+	}
+	w.started = true
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		_, err := w.r.Peek(1)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil && !w.stopped {
+			w.cancel()
+		}
+	}()
+}
+
+// stop ends the background peek so the reader can be used again.
+func (w *clientWatcher) stop() {
+	w.mu.Lock()
+	w.stopped = true
+	started := w.started
+	w.mu.Unlock()
+	if !started {
+		return
+	}
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	w.conn.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+}
+
+// watchBody starts the watcher once body has been read to the end.
+func (w *clientWatcher) watchBody(body io.ReadCloser) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		w.start()
+		return body
+	}
+	return &eofHookReader{body, w.start}
+}
+
+type eofHookReader struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (r *eofHookReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.onEOF()
+	}
+	return n, err
+}
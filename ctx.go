@@ -1,14 +1,23 @@
 package frogproxy
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"io"
 	"net/http"
+	"time"
 )
 
 type CertStorage interface {
 	Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error)
 }
 
+type CertStorageFlusher interface {
+	Flush()
+}
+
 type RoundTripper interface {
 	RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, error)
 }
@@ -17,11 +26,26 @@ type ProxyCtx struct {
 	Req          *http.Request
 	Resp         *http.Response
 	Session      int64
+	RequestID    string
+	TunnelID     string
 	Proxy        *ProxyHttpServer
 	certStore    CertStorage
 	UserData     interface{}
 	RoundTripper RoundTripper
 	Error        error
+	UpstreamALPN []string
+	// DisableConnReuse closes the upstream connection after the response
+	// instead of returning it to the transport's idle pool.
+	DisableConnReuse bool
+	// ConnectAction is the action chosen for the CONNECT this request
+	// arrived through, nil for plain HTTP requests.
+	ConnectAction *ConnectAction
+	ReqBody       []byte
+	origBody      io.ReadCloser
+	started       time.Time
+	span          Span
+	cleanups      []func()
+	spanCtx       context.Context
 }
 
 type RoundTripperFunc func(req *http.Request, ctx *ProxyCtx) (*http.Response, error)
@@ -31,9 +55,46 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
+	if ctx.RequestID != "" {
+		ctx.Proxy.Logger.Printf("[%03d] [%s] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF, ctx.RequestID}, argv...)...)
+		return
+	}
 	ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
 }
 
+// PassThroughBody replaces resp.Body with body, a wrapper that hands the
+// original bytes on unchanged, e.g. to record or count them. Unlike a plain
+// assignment, the proxy keeps treating the response as unmodified, so its
+// Content-Length and ETag survive and an upgraded connection stays
+// writable.
+func (ctx *ProxyCtx) PassThroughBody(resp *http.Response, body io.ReadCloser) {
+	body = keepWritable(resp.Body, body)
+	if resp.Body == ctx.origBody {
+		ctx.origBody = body
+	}
+	resp.Body = body
+}
+
+func (ctx *ProxyCtx) onDone(fn func()) {
+	ctx.cleanups = append(ctx.cleanups, fn)
+}
+
+func (ctx *ProxyCtx) done() {
+	cleanups := ctx.cleanups
+	ctx.cleanups = nil
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+func newRequestID() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
 	if ctx.Proxy.Verbose {
 		ctx.printf("INFO: "+msg, argv...)
@@ -45,8 +106,11 @@ func (ctx *ProxyCtx) Warnf(msg string, argv ...interface{}) {
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx.DisableConnReuse {
+		req.Close = true
+	}
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
+	return ctx.Proxy.roundTripUpstream(ctx, req)
 }
@@ -0,0 +1,54 @@
+package frogproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+var errBodyReadTimeout = errors.New("body read timeout")
+
+type deadlineReader struct {
+	io.ReadCloser
+	timeout     time.Duration
+	setDeadline func(time.Time) error
+}
+
+func newDeadlineReader(rc io.ReadCloser, timeout time.Duration, setDeadline func(time.Time) error) io.ReadCloser {
+	if rc == nil || rc == http.NoBody || timeout <= 0 {
+		return rc
+	}
+	return &deadlineReader{rc, timeout, setDeadline}
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if dr.setDeadline != nil {
+		if err := dr.setDeadline(time.Now().Add(dr.timeout)); err == nil {
+			n, err := dr.ReadCloser.Read(p)
+			if err == io.EOF {
+				dr.setDeadline(time.Time{})
+			}
+			return n, err
+		}
+	}
+	t := time.AfterFunc(dr.timeout, func() {
+		dr.ReadCloser.Close()
+	})
+	n, err := dr.ReadCloser.Read(p)
+	if !t.Stop() && err != nil && err != io.EOF {
+		err = errBodyReadTimeout
+	}
+	return n, err
+}
+
+// Close keeps the read deadline in place until the underlying body is
+// closed: the server drains unread request bodies on Close, and a stalled
+// client must not hold that drain open.
+func (dr *deadlineReader) Close() error {
+	err := dr.ReadCloser.Close()
+	if dr.setDeadline != nil {
+		dr.setDeadline(time.Time{})
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// drip writes n single-byte chunks, pausing gap between them.
+func drip(w http.ResponseWriter, n int, gap time.Duration) {
+	for i := 0; i < n; i++ {
+		io.WriteString(w, "x")
+		w.(http.Flusher).Flush()
+		time.Sleep(gap)
+	}
+}
+
+func TestBodyReadTimeoutAllowsSteadyResponse(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drip(w, 10, 20*time.Millisecond)
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.BodyReadTimeout = 100 * time.Millisecond
+	// The whole body takes longer than the timeout; only gaps count.
+	resp, body := get(t, proxyClient(t, p), up.URL)
+	if resp.StatusCode != http.StatusOK || body != strings.Repeat("x", 10) {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestBodyReadTimeoutReapsStalledResponse(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drip(w, 1, 0)
+		<-release
+	}))
+	defer up.Close()
+	defer close(release)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.BodyReadTimeout = 50 * time.Millisecond
+	// The client sees either a failed request or a truncated body.
+	resp, err := proxyClient(t, p).Get(up.URL)
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	if err == nil {
+		t.Fatal("stalled body read to completion")
+	}
+}
+
+func TestBodyReadTimeoutReapsStalledRequest(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.BodyReadTimeout = 50 * time.Millisecond
+	c := proxyClient(t, p)
+
+	// A slowloris upload: two bytes, then nothing.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("ab"))
+	req, _ := http.NewRequest(http.MethodPost, up.URL, pr)
+	req.ContentLength = 10
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := c.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				t.Errorf("stalled upload was accepted")
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled upload was not reaped")
+	}
+}
@@ -0,0 +1,39 @@
+package frogproxy
+
+import (
+	"net/http"
+
+	"github.com/fj9140/frogproxy/transport"
+)
+
+// roundTripUpstream sends req through the upstream transport. When
+// MaxDecompressedBytes or MaxCompressionRatio is set, the proxy asks for
+// gzip or deflate itself and decodes the body within those limits, rather
+// than letting http.Transport gunzip it without any bound.
+func (proxy *ProxyHttpServer) roundTripUpstream(ctx *ProxyCtx, req *http.Request) (*http.Response, error) {
+	tr := proxy.upstreamTransport(ctx)
+	if proxy.MaxDecompressedBytes <= 0 && proxy.MaxCompressionRatio <= 0 ||
+		tr.DisableCompression || req.Header.Get("Accept-Encoding") != "" {
+		return tr.RoundTrip(req)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if req.Method == http.MethodHead || resp.ContentLength == 0 || encoding != "gzip" && encoding != "deflate" {
+		return resp, nil
+	}
+	decoded, err := transport.NewDecodingReader(resp.Body, encoding, proxy.MaxDecompressedBytes, proxy.MaxCompressionRatio)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = &readCloser{decoded, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
@@ -0,0 +1,85 @@
+package frogproxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func compressedServer(t *testing.T, encoding string, data []byte) *httptest.Server {
+	var buf bytes.Buffer
+	var w io.WriteCloser = gzip.NewWriter(&buf)
+	if encoding == "deflate" {
+		w = zlib.NewWriter(&buf)
+	}
+	w.Write(data)
+	w.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+			w.Write(data)
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProxyDecompressionLimits(t *testing.T) {
+	small := []byte("hello world")
+	bomb := bytes.Repeat([]byte{'a'}, 1<<20)
+	for _, encoding := range []string{"gzip", "deflate"} {
+		p := frogproxy.NewProxyHttpServer()
+		p.MaxDecompressedBytes = 1 << 16
+		c := proxyClient(t, p)
+
+		if _, body := get(t, c, compressedServer(t, encoding, small).URL); body != string(small) {
+			t.Errorf("%s: got %q", encoding, body)
+		}
+
+		resp, err := c.Get(compressedServer(t, encoding, bomb).URL)
+		if err != nil {
+			continue
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err == nil || n > p.MaxDecompressedBytes {
+			t.Errorf("%s: proxy relayed %d decompressed bytes, err %v", encoding, n, err)
+		}
+	}
+}
+
+func TestMitmDecompressionLimits(t *testing.T) {
+	bomb := bytes.Repeat([]byte{'a'}, 1<<20)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(bomb)
+	gz.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.MaxCompressionRatio = 10
+	c, _ := mitmClient(t, p)
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer up.Close()
+
+	resp, err := c.Get(up.URL)
+	if err != nil {
+		return
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil || n >= int64(len(bomb)) {
+		t.Fatalf("proxy relayed %d decompressed bytes, err %v", n, err)
+	}
+}
@@ -1,6 +1,14 @@
 package frogproxy
 
-import "net/http"
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
 
 type ReqCondition interface {
 	RespCondition
@@ -16,8 +24,19 @@ type ReqProxyConds struct {
 	reqConds []ReqCondition
 }
 
+// MaxRouteBodySize caps the request body RouteByBody reads. Larger bodies
+// are forwarded unread to the request's original destination.
+var MaxRouteBodySize int64 = 1 << 20
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 type ReqConditionFunc func(req *http.Request, ctx *ProxyCtx) bool
 
+type RespConditionFunc func(resp *http.Response, ctx *ProxyCtx) bool
+
 type ProxyConds struct {
 	proxy     *ProxyHttpServer
 	reqConds  []ReqCondition
@@ -45,6 +64,18 @@ func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http
 	pcond.Do(FuncRespHandler(f))
 }
 
+func (pcond *ProxyConds) TransformBody(f func(body io.ReadCloser) io.ReadCloser) {
+	pcond.DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil {
+			return resp
+		}
+		resp.Body = f(resp.Body)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp
+	})
+}
+
 func (c ReqConditionFunc) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
 	return c(req, ctx)
 }
@@ -52,6 +83,10 @@ func (c ReqConditionFunc) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
 	return c(ctx.Req, ctx)
 }
 
+func (c RespConditionFunc) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	return c(resp, ctx)
+}
+
 func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) {
 	pcond.Do(FuncReqHandler(f))
 }
@@ -66,6 +101,43 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 			return h.Handle(r, ctx)
 		}))
 }
+
+// RouteByBody reads the whole request body, up to MaxRouteBodySize, and
+// sends the request to the upstream route returns for it, or to its
+// original destination when route returns nil. The body is forwarded as
+// read.
+func (pcond *ReqProxyConds) RouteByBody(route func(body []byte, ctx *ProxyCtx) *url.URL) {
+	pcond.DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody {
+			return req, nil
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, MaxRouteBodySize+1))
+		if err != nil {
+			ctx.Warnf("Cannot read request body for routing: %v", err)
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return req, nil
+		}
+		if int64(len(body)) > MaxRouteBodySize {
+			ctx.Logf("Request body exceeds %d bytes, not routing by body", MaxRouteBodySize)
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return req, nil
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+		if u := route(body, ctx); u != nil {
+			ctx.Logf("Routing %v to %v by body", req.URL, u.Host)
+			req.URL.Scheme = u.Scheme
+			req.URL.Host = u.Host
+			req.Host = u.Host
+		}
+		return req, nil
+	})
+}
+
 func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
 	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
@@ -78,6 +150,25 @@ func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
 		}))
 }
 
+// ExcludeHostsFromMitm tunnels CONNECTs to hosts without MITM, e.g. for
+// clients that pin certificates. It runs before previously registered
+// CONNECT handlers, so it takes precedence over a catch-all AlwaysMitm.
+func (pcond *ReqProxyConds) ExcludeHostsFromMitm(hosts ...string) {
+	excluded := DstHostIsOneOf(hosts...)
+	h := FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		for _, cond := range pcond.reqConds {
+			if !cond.HandleReq(ctx.Req, ctx) {
+				return nil, ""
+			}
+		}
+		if !excluded(ctx.Req, ctx) {
+			return nil, ""
+		}
+		return OKConnect, host
+	})
+	pcond.proxy.httpsHandlers = append([]HttpsHandler{h}, pcond.proxy.httpsHandlers...)
+}
+
 func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
 	return &ReqProxyConds{proxy, conds}
 }
@@ -86,12 +177,237 @@ func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
 	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
 }
 
+type notCondition struct {
+	c ReqCondition
+}
+
+// Not matches requests c does not match. As a response condition it
+// inverts c's HandleResp.
+func Not(c ReqCondition) ReqCondition {
+	return notCondition{c}
+}
+
+func (n notCondition) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
+	return !n.c.HandleReq(req, ctx)
+}
+
+func (n notCondition) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	return !n.c.HandleResp(resp, ctx)
+}
+
+type orCondition []ReqCondition
+
+// Or matches when any of conds does, trying them in order and stopping at
+// the first match. As a response condition it asks each one's HandleResp.
+func Or(conds ...ReqCondition) ReqCondition {
+	return orCondition(conds)
+}
+
+func (o orCondition) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
+	for _, c := range o {
+		if c.HandleReq(req, ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o orCondition) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	for _, c := range o {
+		if c.HandleResp(resp, ctx) {
+			return true
+		}
+	}
+	return false
+}
+
 func DstHostIs(host string) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
 		return req.URL.Host == host
 	}
 }
 
+// DstHostIsOneOf matches requests whose URL host is one of hosts, ignoring
+// case. A host listed without a port matches it on any port.
+func DstHostIsOneOf(hosts ...string) ReqConditionFunc {
+	set := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		set[strings.ToLower(h)] = struct{}{}
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host := strings.ToLower(req.URL.Host)
+		if _, ok := set[host]; ok {
+			return true
+		}
+		_, ok := set[stripPort(host)]
+		return ok
+	}
+}
+
+func AuthorityIs(host string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		authority := req.Host
+		if authority == "" && req.URL != nil {
+			authority = req.URL.Host
+		}
+		if strings.EqualFold(authority, host) {
+			return true
+		}
+		return !hasPort.MatchString(host) && strings.EqualFold(stripPort(authority), host)
+	}
+}
+
+func UrlMatches(re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return req.URL != nil && re.MatchString(req.URL.String())
+	}
+}
+
+func UrlHasPrefix(prefix string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		if req.URL == nil {
+			return false
+		}
+		host := req.URL.Host
+		// MITM'd requests carry the CONNECT target, e.g. "example.com:443";
+		// drop a default port so the prefix matches either form.
+		if port := req.URL.Port(); port == "443" && req.URL.Scheme == "https" || port == "80" && req.URL.Scheme == "http" {
+			host = strings.TrimSuffix(host, ":"+port)
+		}
+		if len(prefix) <= len(host) {
+			return strings.HasPrefix(host, prefix)
+		}
+		return strings.HasPrefix(prefix, host) && strings.HasPrefix(req.URL.Path, prefix[len(host):])
+	}
+}
+
+// ReqHostMatches matches against the Host header the client sent (req.Host).
+// req.URL.Host is only consulted when req.Host is empty; use DstHostIs to
+// match the parsed URL instead.
+func ReqHostMatches(re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host := req.Host
+		if host == "" && req.URL != nil {
+			host = req.URL.Host
+		}
+		return re.MatchString(host)
+	}
+}
+
+// PathGlob matches req.URL.Path against a slash-separated glob. A "*" matches
+// any characters within a single path segment (a segment that is exactly "*"
+// must be non-empty), and a "**" segment matches zero or more whole segments,
+// so "/api/**" matches "/api", "/api/" and "/api/v1/users".
+func PathGlob(pattern string) ReqConditionFunc {
+	re := regexp.MustCompile(globToRegexp(pattern))
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return req.URL != nil && re.MatchString(req.URL.Path)
+	}
+}
+
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i, seg := range strings.Split(pattern, "/") {
+		switch {
+		case seg == "**" && i == 0:
+			b.WriteString(`[^/]*(?:/[^/]*)*`)
+		case seg == "**":
+			b.WriteString(`(?:/[^/]*)*`)
+		default:
+			if i > 0 {
+				b.WriteString("/")
+			}
+			if seg == "*" {
+				b.WriteString(`[^/]+`)
+			} else {
+				b.WriteString(strings.ReplaceAll(regexp.QuoteMeta(seg), `\*`, `[^/]*`))
+			}
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func SrcIpIs(ips ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host := remoteHost(req)
+		src := net.ParseIP(host)
+		for _, ip := range ips {
+			if src != nil && src.Equal(net.ParseIP(strings.Trim(ip, "[]"))) {
+				return true
+			}
+			if ip == host {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func ReqMethodIs(methods ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, m := range methods {
+			if strings.EqualFold(req.Method, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func SrcIpInCIDR(cidr string) (ReqConditionFunc, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		ip := net.ParseIP(remoteHost(req))
+		return ip != nil && network.Contains(ip)
+	}, nil
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = strings.Trim(req.RemoteAddr, "[]")
+	}
+	return host
+}
+
+func RespHeaderMissing(name string) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		return resp.Header.Get(name) == ""
+	}
+}
+
+func ContentTypeIs(typ string, types ...string) RespConditionFunc {
+	types = append([]string{typ}, types...)
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		contentType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+		contentType = strings.TrimSpace(contentType)
+		if contentType == "" {
+			return false
+		}
+		for _, t := range types {
+			if strings.EqualFold(t, contentType) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 var AlwaysMitm FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	return MitmConnect, host
 }
+
+var AlwaysReject FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	return RejectConnect, host
+}
@@ -0,0 +1,532 @@
+package frogproxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// answerLocally makes p answer requests matching cond itself, so tests
+// can use any hostname without reaching the network.
+func answerLocally(p *frogproxy.ProxyHttpServer, cond frogproxy.ReqCondition) {
+	p.OnRequest(cond).DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return r, frogproxy.NewResponse(r, frogproxy.ContentTypeText, http.StatusOK, "matched")
+	})
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return r, frogproxy.NewResponse(r, frogproxy.ContentTypeText, http.StatusNotFound, "not matched")
+	})
+}
+
+func TestUrlHasPrefix(t *testing.T) {
+	tests := []struct {
+		url   string
+		match bool
+	}{
+		{"http://example.com/api/v1", true},
+		{"http://example.com:80/api/v1", true},
+		{"https://example.com/api/v1", true},
+		{"http://example.com/other", false},
+		{"http://example.com:8080/api/v1", false},
+		{"https://example.org/api/v1", false},
+	}
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	answerLocally(p, frogproxy.UrlHasPrefix("example.com/api"))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, tt := range tests {
+		resp, body := get(t, c, tt.url)
+		if match := resp.StatusCode == http.StatusOK; match != tt.match {
+			t.Errorf("%s: matched = %v (%q), want %v", tt.url, match, body, tt.match)
+		}
+	}
+}
+
+func TestRespHeaderMissing(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/present":
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		case "/empty":
+			w.Header()["X-Frame-Options"] = []string{""}
+		}
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse(frogproxy.RespHeaderMissing("X-Frame-Options")).DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Frame-Options", "DENY")
+		return resp
+	})
+	c := proxyClient(t, p)
+
+	for path, want := range map[string]string{
+		"/present": "SAMEORIGIN",
+		"/absent":  "DENY",
+		"/empty":   "DENY",
+	} {
+		resp, _ := get(t, c, up.URL+path)
+		if got := resp.Header.Get("X-Frame-Options"); got != want {
+			t.Errorf("%s: X-Frame-Options = %q, want %q", path, got, want)
+		}
+	}
+
+	if frogproxy.RespHeaderMissing("X-Frame-Options").HandleResp(nil, nil) {
+		t.Error("matched a nil response")
+	}
+}
+
+// splitCond answers requests and responses differently and counts how
+// often it is asked.
+type splitCond struct {
+	req, resp bool
+	calls     *int
+}
+
+func (c splitCond) HandleReq(req *http.Request, ctx *frogproxy.ProxyCtx) bool {
+	*c.calls++
+	return c.req
+}
+
+func (c splitCond) HandleResp(resp *http.Response, ctx *frogproxy.ProxyCtx) bool {
+	*c.calls++
+	return c.resp
+}
+
+func TestNot(t *testing.T) {
+	var calls int
+	for _, tt := range []struct {
+		cond      frogproxy.ReqCondition
+		req, resp bool
+	}{
+		{splitCond{true, false, &calls}, false, true},
+		{splitCond{false, true, &calls}, true, false},
+		{frogproxy.Not(splitCond{true, false, &calls}), true, false},
+	} {
+		not := frogproxy.Not(tt.cond)
+		if got := not.HandleReq(nil, nil); got != tt.req {
+			t.Errorf("Not(%+v).HandleReq = %v, want %v", tt.cond, got, tt.req)
+		}
+		if got := not.HandleResp(nil, nil); got != tt.resp {
+			t.Errorf("Not(%+v).HandleResp = %v, want %v", tt.cond, got, tt.resp)
+		}
+	}
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse(frogproxy.Not(splitCond{true, false, &calls})).DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Not", "1")
+		return resp
+	})
+	if resp, _ := get(t, proxyClient(t, p), up.URL); resp.Header.Get("X-Not") != "1" {
+		t.Error("response handler under Not did not use the condition's HandleResp")
+	}
+}
+
+func TestOr(t *testing.T) {
+	for _, tt := range []struct {
+		conds               [][2]bool
+		req, resp           bool
+		reqCalls, respCalls int
+	}{
+		{nil, false, false, 0, 0},
+		{[][2]bool{{true, false}, {false, false}}, true, false, 1, 2},
+		{[][2]bool{{false, true}, {true, false}}, true, true, 2, 1},
+		{[][2]bool{{false, false}, {false, true}}, false, true, 2, 2},
+	} {
+		var calls int
+		var conds []frogproxy.ReqCondition
+		for _, c := range tt.conds {
+			conds = append(conds, splitCond{c[0], c[1], &calls})
+		}
+		or := frogproxy.Or(conds...)
+		if got := or.HandleReq(nil, nil); got != tt.req || calls != tt.reqCalls {
+			t.Errorf("Or(%v).HandleReq = %v after %d checks, want %v after %d", tt.conds, got, calls, tt.req, tt.reqCalls)
+		}
+		calls = 0
+		if got := or.HandleResp(nil, nil); got != tt.resp || calls != tt.respCalls {
+			t.Errorf("Or(%v).HandleResp = %v after %d checks, want %v after %d", tt.conds, got, calls, tt.resp, tt.respCalls)
+		}
+	}
+}
+
+func TestRouteByBody(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			io.WriteString(w, name+":"+string(b))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	def, users, orders := upstream("default"), upstream("users"), upstream("orders")
+	routes := map[string]string{"GetUser": users.URL, "ListOrders": orders.URL}
+
+	defer func(n int64) { frogproxy.MaxRouteBodySize = n }(frogproxy.MaxRouteBodySize)
+	frogproxy.MaxRouteBodySize = 64
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().RouteByBody(func(body []byte, ctx *frogproxy.ProxyCtx) *url.URL {
+		var op struct {
+			OperationName string `json:"operationName"`
+		}
+		json.Unmarshal(body, &op)
+		if u, ok := routes[op.OperationName]; ok {
+			parsed, _ := url.Parse(u)
+			return parsed
+		}
+		return nil
+	})
+	c := proxyClient(t, p)
+
+	for _, tt := range []struct {
+		body, want string
+	}{
+		{`{"operationName":"GetUser"}`, "users"},
+		{`{"operationName":"ListOrders"}`, "orders"},
+		{`{"operationName":"Unknown"}`, "default"},
+		{`{"operationName":"GetUser","query":"` + strings.Repeat("x", 64) + `"}`, "default"},
+	} {
+		resp, err := c.Post(def.URL+"/graphql", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := tt.want + ":" + tt.body; string(b) != want {
+			t.Errorf("got %q, want %q", b, want)
+		}
+	}
+}
+
+func TestSrcIpIs(t *testing.T) {
+	tests := []struct {
+		remote string
+		ips    []string
+		match  bool
+	}{
+		{"192.0.2.1:1234", []string{"192.0.2.1"}, true},
+		{"192.0.2.1:1234", []string{"192.0.2.2", "192.0.2.1"}, true},
+		{"192.0.2.1:1234", []string{"192.0.2.2"}, false},
+		{"[2001:db8::1]:443", []string{"2001:db8::1"}, true},
+		{"[2001:db8::1]:443", []string{"[2001:0db8:0:0::1]"}, true},
+		{"[::ffff:192.0.2.1]:80", []string{"192.0.2.1"}, true},
+		{"unix-socket", []string{"unix-socket"}, true},
+		{"192.0.2.1:1234", nil, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		if got := frogproxy.SrcIpIs(tt.ips...).HandleReq(req, nil); got != tt.match {
+			t.Errorf("SrcIpIs(%v) from %s = %v, want %v", tt.ips, tt.remote, got, tt.match)
+		}
+	}
+}
+
+func TestSrcIpInCIDR(t *testing.T) {
+	tests := []struct {
+		cidr   string
+		remote string
+		match  bool
+	}{
+		{"192.0.2.0/24", "192.0.2.77:1234", true},
+		{"192.0.2.0/24", "198.51.100.1:1234", false},
+		{"192.0.2.0/24", "[::ffff:192.0.2.5]:80", true},
+		{"2001:db8::/32", "[2001:db8::1]:443", true},
+		{"2001:db8::/32", "[2001:db9::1]:443", false},
+		{"192.0.2.0/24", "unix-socket", false},
+	}
+	for _, tt := range tests {
+		cond, err := frogproxy.SrcIpInCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		if got := cond(req, nil); got != tt.match {
+			t.Errorf("SrcIpInCIDR(%s) from %s = %v, want %v", tt.cidr, tt.remote, got, tt.match)
+		}
+	}
+	for _, cidr := range []string{"", "192.0.2.1", "192.0.2.0/33", "not-a-cidr/8"} {
+		if _, err := frogproxy.SrcIpInCIDR(cidr); err == nil {
+			t.Errorf("SrcIpInCIDR(%q) did not fail", cidr)
+		}
+	}
+}
+
+func TestAuthorityIs(t *testing.T) {
+	tests := []struct {
+		url   string
+		host  string
+		want  string
+		match bool
+	}{
+		{"http://example.com/", "", "example.com", true},
+		{"http://example.com/", "", "EXAMPLE.com", true},
+		{"http://example.com:8080/", "", "example.com", true},
+		{"http://example.com:8080/", "", "example.com:8080", true},
+		{"http://example.com:8080/", "", "example.com:9090", false},
+		{"http://example.com/", "", "example.com:80", false},
+		{"http://example.com/", "other.com", "other.com", true},
+		{"http://example.com/", "other.com", "example.com", false},
+		{"/path", "", "example.com", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://placeholder/", nil)
+		req.URL, _ = url.Parse(tt.url)
+		req.Host = tt.host
+		if got := frogproxy.AuthorityIs(tt.want)(req, nil); got != tt.match {
+			t.Errorf("AuthorityIs(%s) on url %s host %q = %v, want %v", tt.want, tt.url, tt.host, got, tt.match)
+		}
+	}
+
+	// HTTP/1.1 carries the authority in Host, HTTP/2 in :authority; both
+	// reach handlers as req.Host and must match alike.
+	for _, h2 := range []bool{false, true} {
+		matched := make(chan bool, 1)
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			matched <- frogproxy.AuthorityIs("example.com")(r, nil)
+		}))
+		srv.EnableHTTP2 = h2
+		srv.StartTLS()
+		c := srv.Client()
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Host = "example.com"
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		wantProto := 1
+		if h2 {
+			wantProto = 2
+		}
+		if resp.ProtoMajor != wantProto {
+			t.Errorf("spoke HTTP/%d, want HTTP/%d", resp.ProtoMajor, wantProto)
+		}
+		if !<-matched {
+			t.Errorf("AuthorityIs did not match over HTTP/%d", resp.ProtoMajor)
+		}
+		srv.Close()
+	}
+}
+
+func TestPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/api/**", "/api", true},
+		{"/api/**", "/api/", true},
+		{"/api/**", "/api/v1/users", true},
+		{"/api/**", "/apiv1", false},
+		{"/api/*", "/api/users", true},
+		{"/api/*", "/api/", false},
+		{"/api/*", "/api/v1/users", false},
+		{"/*.js", "/app.js", true},
+		{"/*.js", "/static/app.js", false},
+		{"/**/*.js", "/app.js", true},
+		{"/**/*.js", "/static/js/app.js", true},
+		{"/**/*.js", "/app.css", false},
+		{"/a/**/b", "/a/b", true},
+		{"/a/**/b", "/a/x/y/b", true},
+		{"/a/**/b", "/a/xb", false},
+		{"/v1.0/status", "/v1.0/status", true},
+		{"/v1.0/status", "/v1x0/status", false},
+		{"**", "/anything/at/all", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		if got := frogproxy.PathGlob(tt.pattern)(req, nil); got != tt.match {
+			t.Errorf("PathGlob(%q) on %q = %v, want %v", tt.pattern, tt.path, got, tt.match)
+		}
+	}
+}
+
+type upperReader struct{ io.ReadCloser }
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+func TestTransformBody(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/"+strings.TrimPrefix(r.URL.Path, "/"))
+		w.Header().Set("Content-Length", "11")
+		io.WriteString(w, "hello world")
+	}))
+	defer up.Close()
+
+	double := func(body io.ReadCloser) io.ReadCloser {
+		b, _ := io.ReadAll(body)
+		body.Close()
+		return io.NopCloser(bytes.NewReader(bytes.Repeat(b, 2)))
+	}
+	upper := func(body io.ReadCloser) io.ReadCloser { return upperReader{body} }
+	tests := []struct {
+		name      string
+		transform func(io.ReadCloser) io.ReadCloser
+		path      string
+		want      string
+	}{
+		{"uppercase", upper, "/plain", "HELLO WORLD"},
+		{"longer body", double, "/plain", "hello worldhello world"},
+		{"condition not met", upper, "/html", "hello world"},
+	}
+	for _, tt := range tests {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnResponse(frogproxy.ContentTypeIs("text/plain")).TransformBody(tt.transform)
+		resp, body := get(t, proxyClient(t, p), up.URL+tt.path)
+		if body != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, body, tt.want)
+		}
+		if resp.ContentLength != -1 && resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s: Content-Length %d for a %d byte body", tt.name, resp.ContentLength, len(body))
+		}
+	}
+}
+
+func TestUrlMatches(t *testing.T) {
+	tests := []struct {
+		url   string
+		match bool
+	}{
+		{"http://example.com/api/v1", true},
+		{"http://example.com/api/v1?debug=1", true},
+		{"https://example.com/api/v2", true},
+		{"http://example.com/api/latest", false},
+		{"http://example.org/api/v1", false},
+		{"https://example.com/static/api/v1", false},
+	}
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	answerLocally(p, frogproxy.UrlMatches(regexp.MustCompile(`^https?://example\.com(:\d+)?/api/v\d+(\?|$)`)))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, tt := range tests {
+		resp, body := get(t, c, tt.url)
+		if match := resp.StatusCode == http.StatusOK; match != tt.match {
+			t.Errorf("%s: matched = %v (%q), want %v", tt.url, match, body, tt.match)
+		}
+	}
+}
+
+func TestDstHostIsOneOf(t *testing.T) {
+	cond := frogproxy.DstHostIsOneOf("Example.com", "api.example.org:8443")
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM", true},
+		{"example.com:443", true},
+		{"api.example.org:8443", true},
+		{"api.example.org", false},
+		{"api.example.org:443", false},
+		{"www.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		req := &http.Request{URL: &url.URL{Host: tt.host}}
+		if got := cond.HandleReq(req, nil); got != tt.match {
+			t.Errorf("%q: matched = %v, want %v", tt.host, got, tt.match)
+		}
+	}
+}
+
+func TestReqHostMatches(t *testing.T) {
+	cond := frogproxy.ReqHostMatches(regexp.MustCompile(`^(www\.)?example\.com(:\d+)?$`))
+	tests := []struct {
+		host, urlHost string
+		match         bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com:8080", "10.0.0.1:8080", true},
+		{"other.com", "example.com", false},
+		{"", "example.com", true},
+		{"", "other.com", false},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Host: tt.host, URL: &url.URL{Host: tt.urlHost}}
+		if got := cond.HandleReq(req, nil); got != tt.match {
+			t.Errorf("Host %q, URL host %q: matched = %v, want %v", tt.host, tt.urlHost, got, tt.match)
+		}
+	}
+}
+
+func TestContentTypeIs(t *testing.T) {
+	cond := frogproxy.ContentTypeIs("text/html", "application/xhtml+xml")
+	tests := []struct {
+		contentType string
+		match       bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"TEXT/HTML;charset=UTF-8", true},
+		{" text/html ; q=1", true},
+		{"application/xhtml+xml", true},
+		{"text/plain", false},
+		{"text/htmlx", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: make(http.Header)}
+		if tt.contentType != "" {
+			resp.Header.Set("Content-Type", tt.contentType)
+		}
+		if got := cond.HandleResp(resp, nil); got != tt.match {
+			t.Errorf("%q: matched = %v, want %v", tt.contentType, got, tt.match)
+		}
+	}
+	if cond.HandleResp(nil, nil) {
+		t.Error("matched a nil response")
+	}
+}
+
+func TestReqMethodIs(t *testing.T) {
+	cond := frogproxy.ReqMethodIs("post", "PUT", "Patch")
+	tests := []struct {
+		method string
+		match  bool
+	}{
+		{"POST", true},
+		{"put", true},
+		{"PATCH", true},
+		{"GET", false},
+		{"CONNECT", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com/", nil)
+		if got := cond.HandleReq(req, nil); got != tt.match {
+			t.Errorf("%s: HandleReq = %v, want %v", tt.method, got, tt.match)
+		}
+		ctx := &frogproxy.ProxyCtx{Req: req}
+		if got := cond.HandleResp(&http.Response{Request: req}, ctx); got != tt.match {
+			t.Errorf("%s: HandleResp = %v, want %v", tt.method, got, tt.match)
+		}
+	}
+	if frogproxy.ReqMethodIs().HandleReq(httptest.NewRequest("GET", "/", nil), nil) {
+		t.Error("ReqMethodIs() matched")
+	}
+}
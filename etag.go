@@ -0,0 +1,30 @@
+package frogproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+func RecomputeETag() RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || resp.Body == ctx.origBody {
+			return resp
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			ctx.Warnf("Cannot read modified response body for ETag: %v", err)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp
+		}
+		sum := sha256.Sum256(body)
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		resp.Header.Del("Last-Modified")
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return resp
+	})
+}
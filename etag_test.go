@@ -0,0 +1,48 @@
+package frogproxy_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestRecomputeETag(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"upstream"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		io.WriteString(w, "original")
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+		if ctx.Req.URL.Path != "/rewrite" {
+			return resp
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader([]byte("modified")))
+		return resp
+	})
+	p.OnResponse().Do(frogproxy.RecomputeETag())
+	c := proxyClient(t, p)
+
+	resp, body := get(t, c, up.URL+"/rewrite")
+	sum := sha256.Sum256([]byte("modified"))
+	if want := `"` + hex.EncodeToString(sum[:16]) + `"`; body != "modified" || resp.Header.Get("ETag") != want {
+		t.Fatalf("modified: got %q with ETag %s, want ETag %s", body, resp.Header.Get("ETag"), want)
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		t.Fatalf("modified: Last-Modified kept: %s", lm)
+	}
+
+	resp, body = get(t, c, up.URL+"/keep")
+	if body != "original" || resp.Header.Get("ETag") != `"upstream"` || resp.Header.Get("Last-Modified") == "" {
+		t.Fatalf("unmodified: got %q with ETag %s, Last-Modified %q", body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	}
+}
@@ -25,6 +25,13 @@ func (tcs *CertStorage) Fetch(host string, gen func() (*tls.Certificate, error))
 	return &cert, nil
 }
 
+func (tcs *CertStorage) Flush() {
+	tcs.certs.Range(func(key, _ interface{}) bool {
+		tcs.certs.Delete(key)
+		return true
+	})
+}
+
 func NewCertStorage() *CertStorage {
 	tcs := &CertStorage{}
 	tcs.certs = sync.Map{}
@@ -1,18 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"os/signal"
 	"path"
-	"sync"
 	"time"
 
 	"github.com/fj9140/frogproxy"
@@ -109,29 +108,6 @@ func NewFileStream(path string) *FileStream {
 	return &FileStream{path, nil}
 }
 
-type TeeReadCloser struct {
-	r io.Reader
-	w io.WriteCloser
-	c io.Closer
-}
-
-func (t *TeeReadCloser) Close() error {
-	err1 := t.c.Close()
-	err2 := t.w.Close()
-	if err1 != nil {
-		return err1
-	}
-	return err2
-}
-
-func (t *TeeReadCloser) Read(p []byte) (int, error) {
-	return t.r.Read(p)
-}
-
-func NewTeeReadCloser(r io.ReadCloser, w io.WriteCloser) io.ReadCloser {
-	return &TeeReadCloser{io.TeeReader(r, w), w, r}
-}
-
 func NewLogger(basepath string) (*HttpLogger, error) {
 	f, err := os.Create(path.Join(basepath, "log"))
 	if err != nil {
@@ -149,33 +125,6 @@ func NewLogger(basepath string) (*HttpLogger, error) {
 	return logger, nil
 }
 
-type stoppableListener struct {
-	net.Listener
-	sync.WaitGroup
-}
-type stoppableConn struct {
-	net.Conn
-	wg *sync.WaitGroup
-}
-
-func (sl *stoppableListener) Accept() (net.Conn, error) {
-	c, err := sl.Listener.Accept()
-	if err != nil {
-		return c, err
-	}
-	sl.Add(1)
-	return &stoppableConn{c, &sl.WaitGroup}, nil
-}
-
-func (sc *stoppableConn) Close() error {
-	sc.wg.Done()
-	return sc.Conn.Close()
-}
-
-func newStoppableListener(l net.Listener) *stoppableListener {
-	return &stoppableListener{l, sync.WaitGroup{}}
-}
-
 var emptyResp = &http.Response{}
 var emptyReq = &http.Request{}
 
@@ -188,7 +137,7 @@ func (logger *HttpLogger) LogResp(resp *http.Response, ctx *frogproxy.ProxyCtx)
 	if resp == nil {
 		resp = emptyResp
 	} else {
-		resp.Body = NewTeeReadCloser(resp.Body, NewFileStream(body))
+		ctx.PassThroughBody(resp, frogproxy.NewTeeReadCloser(resp.Body, NewFileStream(body)))
 	}
 	logger.LogMeta(&Meta{
 		resp: resp,
@@ -205,7 +154,7 @@ func (logger *HttpLogger) LogReq(req *http.Request, ctx *frogproxy.ProxyCtx) {
 	if req == nil {
 		req = emptyReq
 	} else {
-		req.Body = NewTeeReadCloser(req.Body, NewFileStream(body))
+		req.Body = frogproxy.NewTeeReadCloser(req.Body, NewFileStream(body))
 	}
 
 	logger.LogMeta(&Meta{
@@ -254,23 +203,22 @@ func main() {
 		return resp
 	})
 
-	l, err := net.Listen("tcp", *addr)
-	if err != nil {
-		log.Fatal("listen: ", err)
-	}
-	sl := newStoppableListener(l)
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
+	done := make(chan struct{})
 	go func() {
 		<-ch
 		log.Println("Got SIGINT exiting")
-		sl.Add(1)
-		sl.Close()
+		if err := proxy.Shutdown(context.Background()); err != nil {
+			log.Println("Shutdown:", err)
+		}
 		logger.Close()
-		sl.Done()
+		close(done)
 	}()
 	log.Println("Starting Proxy")
-	http.Serve(sl, proxy)
-	sl.Wait()
+	if err := proxy.ListenAndServe(*addr); err != http.ErrServerClosed {
+		log.Fatal("listen: ", err)
+	}
+	<-done
 	log.Println("All connection closed - exit")
 }
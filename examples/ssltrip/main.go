@@ -20,6 +20,7 @@ func main() {
 		}
 		return req, nil
 	})
+	proxy.OnResponse().Do(frogproxy.StripHSTS())
 
 	proxy.Verbose = *verbose
 	log.Fatal(http.ListenAndServe(*addr, proxy))
@@ -0,0 +1,42 @@
+package frogproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+func hasChunked(te []string) bool {
+	for _, v := range te {
+		for _, coding := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "chunked") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ambiguousFraming checks a message for both Content-Length and chunked
+// Transfer-Encoding, rejecting it when RejectAmbiguousFraming is set and
+// otherwise dropping Content-Length.
+//
+// Only messages built or rewritten by handlers can reach this state: Go's
+// http.ReadRequest and http.ReadResponse already discard Content-Length
+// from chunked messages they parse off the wire, whether they come from
+// clients, MITM tunnels or upstream servers.
+func (proxy *ProxyHttpServer) ambiguousFraming(ctx *ProxyCtx, h http.Header, te []string) bool {
+	if h.Get("Content-Length") == "" || !(hasChunked(te) || hasChunked(h.Values("Transfer-Encoding"))) {
+		return false
+	}
+	if proxy.RejectAmbiguousFraming {
+		ctx.Warnf("Rejecting message with both Transfer-Encoding: chunked and Content-Length")
+		return true
+	}
+	ctx.Logf("Stripping Content-Length from chunked message")
+	h.Del("Content-Length")
+	return false
+}
+
+func ambiguousFramingResponse(r *http.Request, status int) *http.Response {
+	return NewResponse(r, ContentTypeText, status, "ambiguous message framing: both Transfer-Encoding and Content-Length present")
+}
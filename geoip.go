@@ -0,0 +1,34 @@
+package frogproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+type GeoIPResolver interface {
+	Country(ip net.IP) (string, error)
+}
+
+func SrcCountryIs(codes ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		if ctx.Proxy.GeoIP == nil {
+			return false
+		}
+		ip := net.ParseIP(remoteHost(req))
+		if ip == nil {
+			return false
+		}
+		country, err := ctx.Proxy.GeoIP.Country(ip)
+		if err != nil {
+			ctx.Warnf("Cannot resolve country of %v: %v", ip, err)
+			return false
+		}
+		for _, code := range codes {
+			if strings.EqualFold(code, country) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,49 @@
+package frogproxy_test
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// geoTable resolves countries from a fixed table.
+type geoTable map[string]string
+
+func (g geoTable) Country(ip net.IP) (string, error) {
+	if c, ok := g[ip.String()]; ok {
+		return c, nil
+	}
+	return "", errors.New("unknown address")
+}
+
+func TestSrcCountryIs(t *testing.T) {
+	geo := geoTable{"203.0.113.7": "NL", "2001:db8::1": "DE"}
+	tests := []struct {
+		remote string
+		geo    frogproxy.GeoIPResolver
+		codes  []string
+		match  bool
+	}{
+		{"203.0.113.7:5555", geo, []string{"NL"}, true},
+		{"203.0.113.7:5555", geo, []string{"de", "nl"}, true},
+		{"203.0.113.7:5555", geo, []string{"DE"}, false},
+		{"[2001:db8::1]:443", geo, []string{"DE"}, true},
+		{"198.51.100.1:5555", geo, []string{"NL"}, false},
+		{"not-an-ip", geo, []string{"NL"}, false},
+		{"203.0.113.7:5555", nil, []string{"NL"}, false},
+	}
+	for _, tt := range tests {
+		p := frogproxy.NewProxyHttpServer()
+		p.Logger = &logBuffer{}
+		p.GeoIP = tt.geo
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		ctx := &frogproxy.ProxyCtx{Req: req, Proxy: p}
+		if got := frogproxy.SrcCountryIs(tt.codes...).HandleReq(req, ctx); got != tt.match {
+			t.Errorf("SrcCountryIs(%v) from %s = %v, want %v", tt.codes, tt.remote, got, tt.match)
+		}
+	}
+}
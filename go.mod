@@ -1,3 +1,8 @@
 module github.com/fj9140/frogproxy
 
 go 1.22.3
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	golang.org/x/net v0.35.0
+)
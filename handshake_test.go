@@ -0,0 +1,87 @@
+package frogproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcquireHandshakeFollowsLimit(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.MaxConcurrentHandshakes = 1
+	soon := func() time.Time { return time.Now().Add(10 * time.Millisecond) }
+
+	release, ok := proxy.acquireHandshake(soon())
+	if !ok {
+		t.Fatal("first handshake refused")
+	}
+	if _, ok := proxy.acquireHandshake(soon()); ok {
+		t.Fatal("second handshake admitted over a limit of 1")
+	}
+
+	proxy.MaxConcurrentHandshakes = 2
+	release2, ok := proxy.acquireHandshake(soon())
+	if !ok {
+		t.Fatal("raised limit not applied")
+	}
+	release()
+	release2()
+
+	proxy.MaxConcurrentHandshakes = 1
+	release, ok = proxy.acquireHandshake(soon())
+	if !ok {
+		t.Fatal("slot not returned on release")
+	}
+	done := make(chan bool)
+	go func() {
+		_, ok := proxy.acquireHandshake(time.Now().Add(time.Second))
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	if !<-done {
+		t.Fatal("waiting handshake not admitted when a slot freed")
+	}
+}
+
+func TestIsProtocolVersionAlert(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{tls.AlertError(70), true},
+		{fmt.Errorf("dial: %w", tls.AlertError(70)), true},
+		{tls.AlertError(40), false},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: protocol version not supported")}, true},
+		{errors.New("tls: server selected unsupported protocol version 301"), true},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}, false},
+		{errors.New("protocol version"), false},
+		{nil, false},
+	} {
+		if got := isProtocolVersionAlert(tc.err); got != tc.want {
+			t.Errorf("isProtocolVersionAlert(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestIsProtocolVersionAlertFromHandshake(t *testing.T) {
+	cert, err := tls.X509KeyPair(CA_CERT, CA_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}).Handshake()
+
+	err = tls.Client(c, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}).Handshake()
+	if err == nil {
+		t.Fatal("handshake below the server's minimum version succeeded")
+	}
+	if !isProtocolVersionAlert(err) {
+		t.Errorf("isProtocolVersionAlert(%v) = false", err)
+	}
+}
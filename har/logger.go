@@ -0,0 +1,236 @@
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// DefaultMaxBodySize is the number of bytes of each request and response
+// body a new Logger keeps.
+var DefaultMaxBodySize int64 = 1 << 20
+
+type Logger struct {
+	// MaxBodySize caps how much of each body is kept in memory for the
+	// archive. Longer bodies are truncated and marked in the entry comment.
+	MaxBodySize int64
+	path        string
+	mu          sync.Mutex
+	entries     []*entry
+	pending     map[*frogproxy.ProxyCtx]*entry
+}
+
+type entry struct {
+	Entry
+	started  time.Time
+	received time.Time
+	done     time.Time
+	reqBody  *capture
+	respBody *capture
+}
+
+type capture struct {
+	mu    *sync.Mutex
+	buf   bytes.Buffer
+	max   int64
+	total int64
+	end   func()
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += int64(len(p))
+	if room := c.max - int64(c.buf.Len()); room > 0 {
+		c.buf.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+func (c *capture) truncated() bool {
+	return c.total > int64(c.buf.Len())
+}
+
+func (c *capture) Close() error {
+	if c.end != nil {
+		c.mu.Lock()
+		c.end()
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func NewLogger(path string) *Logger {
+	return &Logger{MaxBodySize: DefaultMaxBodySize, path: path, pending: make(map[*frogproxy.ProxyCtx]*entry)}
+}
+
+func (l *Logger) Register(proxy *frogproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(l.logRequest)
+	proxy.OnResponse().DoFunc(l.logResponse)
+}
+
+func (l *Logger) logRequest(req *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+	e := &entry{started: time.Now()}
+	e.Request = Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     cookies(req.Cookies()),
+		Headers:     headers(req.Header),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, NameValue{name, v})
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		e.reqBody = &capture{mu: &l.mu, max: l.MaxBodySize}
+		e.Request.PostData = &PostData{MimeType: req.Header.Get("Content-Type")}
+		req.Body = frogproxy.NewTeeReadCloser(req.Body, e.reqBody)
+	}
+
+	l.mu.Lock()
+	l.pending[ctx] = e
+	l.entries = append(l.entries, e)
+	l.mu.Unlock()
+	return req, nil
+}
+
+func (l *Logger) logResponse(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.pending[ctx]
+	if !ok {
+		return resp
+	}
+	delete(l.pending, ctx)
+	e.received = time.Now()
+	e.done = e.received
+	if resp == nil {
+		e.Response = Response{Cookies: []NameValue{}, Headers: []NameValue{}, HeadersSize: -1, BodySize: -1}
+		if ctx.Error != nil {
+			e.Comment = ctx.Error.Error()
+		}
+		return resp
+	}
+	e.Response = Response{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     cookies(resp.Cookies()),
+		Headers:     headers(resp.Header),
+		Content:     Content{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.ContentLength,
+	}
+	if resp.Body != nil {
+		e.respBody = &capture{mu: &l.mu, max: l.MaxBodySize, end: func() { e.done = time.Now() }}
+		ctx.PassThroughBody(resp, frogproxy.NewTeeReadCloser(resp.Body, e.respBody))
+	}
+	return resp
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	h := HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "frogproxy", Version: "1.0"},
+		Entries: make([]*Entry, 0, len(l.entries)),
+	}}
+	for _, e := range l.entries {
+		h.Log.Entries = append(h.Log.Entries, e.finish())
+	}
+	l.mu.Unlock()
+
+	f, err := os.Create(l.path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (e *entry) finish() *Entry {
+	out := e.Entry
+	out.StartedDateTime = e.started.Format(time.RFC3339Nano)
+	var truncated []string
+	if e.reqBody != nil {
+		out.Request.BodySize = e.reqBody.total
+		out.Request.PostData = &PostData{MimeType: e.Request.PostData.MimeType, Text: e.reqBody.buf.String()}
+		if e.reqBody.truncated() {
+			truncated = append(truncated, "request")
+		}
+	}
+	if e.respBody != nil {
+		body := e.respBody.buf.Bytes()
+		out.Response.BodySize = e.respBody.total
+		out.Response.Content.Size = e.respBody.total
+		if e.respBody.truncated() {
+			truncated = append(truncated, "response")
+		}
+		if utf8.Valid(body) {
+			out.Response.Content.Text = string(body)
+		} else {
+			out.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			out.Response.Content.Encoding = "base64"
+		}
+	}
+	if len(truncated) > 0 {
+		note := strings.Join(truncated, " and ") + " body truncated"
+		if out.Comment != "" {
+			note = out.Comment + "; " + note
+		}
+		out.Comment = note
+	}
+	if !e.received.IsZero() {
+		out.Timings.Wait = millis(e.received.Sub(e.started))
+		out.Timings.Receive = millis(e.done.Sub(e.received))
+	} else {
+		out.Timings.Wait = -1
+		out.Timings.Receive = -1
+	}
+	out.Time = out.Timings.Send + max(out.Timings.Wait, 0) + max(out.Timings.Receive, 0)
+	return &out
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func headers(h http.Header) []NameValue {
+	nv := []NameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			nv = append(nv, NameValue{name, v})
+		}
+	}
+	sort.Slice(nv, func(i, j int) bool { return nv[i].Name < nv[j].Name })
+	return nv
+}
+
+func cookies(cs []*http.Cookie) []NameValue {
+	nv := []NameValue{}
+	for _, c := range cs {
+		nv = append(nv, NameValue{c.Name, c.Value})
+	}
+	return nv
+}
@@ -0,0 +1,83 @@
+package har_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+	"github.com/fj9140/frogproxy/har"
+)
+
+func TestLoggerWritesHAR(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			io.WriteString(w, strings.Repeat("b", 100))
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "hello har")
+	}))
+	defer up.Close()
+
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	l := har.NewLogger(path)
+	l.MaxBodySize = 10
+	p := frogproxy.NewProxyHttpServer()
+	l.Register(p)
+	p.OnResponse().Do(frogproxy.RecomputeETag())
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+
+	resp, err := c.Post(up.URL+"/echo", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// Recording the body must not make it look rewritten.
+	if string(body) != "hello har" || resp.ContentLength != 9 || resp.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("got %q, Content-Length %d, ETag %s", body, resp.ContentLength, resp.Header.Get("ETag"))
+	}
+	resp, err = c.Get(up.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var h har.HAR
+	if err := json.NewDecoder(f).Decode(&h); err != nil {
+		t.Fatalf("archive does not parse: %v", err)
+	}
+	if h.Log.Version != "1.2" || len(h.Log.Entries) != 2 {
+		t.Fatalf("version %q with %d entries", h.Log.Version, len(h.Log.Entries))
+	}
+	post, big := h.Log.Entries[0], h.Log.Entries[1]
+	if post.Request.Method != "POST" || post.Request.PostData == nil || post.Request.PostData.Text != "payload" {
+		t.Fatalf("POST entry request: %+v", post.Request)
+	}
+	if post.Response.Status != 200 || post.Response.Content.Text != "hello har" {
+		t.Fatalf("POST entry response: %+v", post.Response)
+	}
+	if big.Response.Content.Size != 100 || len(big.Response.Content.Text) != 10 || !strings.Contains(big.Comment, "response body truncated") {
+		t.Fatalf("big entry: size %d, %d bytes kept, comment %q", big.Response.Content.Size, len(big.Response.Content.Text), big.Comment)
+	}
+}
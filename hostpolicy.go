@@ -0,0 +1,64 @@
+package frogproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostMismatchPolicy says what the proxy does with a request whose Host
+// header names a different host than its URL, on plain and MITM'd
+// requests alike. Hosts are compared ignoring case and default ports.
+// A net/http server already sets the Host of an absolute-form request to
+// its URL host, so for plain requests it only matters when ServeHTTP is
+// reached some other way.
+type HostMismatchPolicy int
+
+const (
+	// HostMismatchIgnore forwards the request to the URL host with the
+	// Host header unchanged.
+	HostMismatchIgnore HostMismatchPolicy = iota
+	// HostMismatchPreferURL rewrites the Host header to the URL host.
+	HostMismatchPreferURL
+	// HostMismatchPreferHost sends the request to the Host header's host.
+	HostMismatchPreferHost
+	// HostMismatchReject answers 400 Bad Request.
+	HostMismatchReject
+)
+
+func canonicalHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+			return h
+		}
+	}
+	return host
+}
+
+// hostMismatch applies proxy.HostMismatch to a request whose Host header
+// disagrees with its URL host, and reports whether it must be rejected.
+func (proxy *ProxyHttpServer) hostMismatch(ctx *ProxyCtx, r *http.Request) bool {
+	if proxy.HostMismatch == HostMismatchIgnore || r.URL == nil || r.Host == "" {
+		return false
+	}
+	if canonicalHost(r.Host, r.URL.Scheme) == canonicalHost(r.URL.Host, r.URL.Scheme) {
+		return false
+	}
+	switch proxy.HostMismatch {
+	case HostMismatchPreferURL:
+		ctx.Logf("Host %q does not match URL host %q, using URL host", r.Host, r.URL.Host)
+		r.Host = r.URL.Host
+	case HostMismatchPreferHost:
+		ctx.Logf("Host %q does not match URL host %q, using Host header", r.Host, r.URL.Host)
+		r.URL.Host = r.Host
+	case HostMismatchReject:
+		ctx.Warnf("Rejecting request: Host %q does not match URL host %q", r.Host, r.URL.Host)
+		return true
+	}
+	return false
+}
+
+func hostMismatchResponse(r *http.Request) *http.Response {
+	return NewResponse(r, ContentTypeText, http.StatusBadRequest, "Host header does not match request URL")
+}
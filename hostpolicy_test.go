@@ -0,0 +1,73 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestHostMismatch(t *testing.T) {
+	origin := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.Host)
+		}
+	}
+	servers := map[bool][2]*httptest.Server{
+		false: {httptest.NewServer(origin("a")), httptest.NewServer(origin("b"))},
+		true:  {httptest.NewTLSServer(origin("a")), httptest.NewTLSServer(origin("b"))},
+	}
+	for _, pair := range servers {
+		defer pair[0].Close()
+		defer pair[1].Close()
+	}
+	host := func(s *httptest.Server) string { return s.Listener.Addr().String() }
+
+	for _, mitm := range []bool{false, true} {
+		a, b := servers[mitm][0], servers[mitm][1]
+		for _, tt := range []struct {
+			policy   frogproxy.HostMismatchPolicy
+			header   string
+			status   int
+			wantBody string
+		}{
+			{frogproxy.HostMismatchReject, host(a), http.StatusOK, "a " + host(a)},
+			{frogproxy.HostMismatchPreferHost, host(a), http.StatusOK, "a " + host(a)},
+			{frogproxy.HostMismatchIgnore, host(b), http.StatusOK, "a " + host(b)},
+			{frogproxy.HostMismatchPreferURL, host(b), http.StatusOK, "a " + host(a)},
+			{frogproxy.HostMismatchPreferHost, host(b), http.StatusOK, "b " + host(b)},
+			{frogproxy.HostMismatchReject, host(b), http.StatusBadRequest, ""},
+		} {
+			p := frogproxy.NewProxyHttpServer()
+			p.HostMismatch = tt.policy
+			var resp *http.Response
+			if mitm {
+				c, _ := mitmClient(t, p)
+				req, _ := http.NewRequest("GET", a.URL, nil)
+				req.Host = tt.header
+				var err error
+				if resp, err = c.Do(req); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				// net/http clients and servers both resolve the request line
+				// and Host header to one host, so hand the proxy a request as
+				// another front end might.
+				req := httptest.NewRequest("GET", a.URL+"/", nil)
+				req.Host = tt.header
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, req)
+				resp = rec.Result()
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || (tt.wantBody != "" && string(body) != tt.wantBody) {
+				t.Errorf("mitm=%v policy %d, Host %s: got %d %q, want %d %q",
+					mitm, tt.policy, tt.header, resp.StatusCode, strings.TrimSpace(string(body)), tt.status, tt.wantBody)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package frogproxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// DefaultMaxHostStats is the number of hosts EnableHostStats tracks when
+// given a non-positive limit.
+var DefaultMaxHostStats = 1024
+
+// HostStat is the traffic seen for one destination host, port excluded.
+// Bytes counts response bytes sent to clients, or tunnelled bytes for
+// CONNECT.
+type HostStat struct {
+	Host     string
+	Requests int64
+	Bytes    int64
+}
+
+type hostStats struct {
+	mu    sync.Mutex
+	max   int
+	hosts map[string]*HostStat
+}
+
+// EnableHostStats starts counting requests and bytes per destination host
+// for TopHosts. At most maxHosts hosts are kept; when a new host arrives at
+// the limit, the quietest one is dropped. Call it before serving.
+func (proxy *ProxyHttpServer) EnableHostStats(maxHosts int) {
+	if maxHosts <= 0 {
+		maxHosts = DefaultMaxHostStats
+	}
+	proxy.hostStats = &hostStats{max: maxHosts, hosts: make(map[string]*HostStat)}
+}
+
+// TopHosts returns up to n tracked hosts, busiest first: ordered by request
+// count, then bytes, then name. A negative n returns every host. It returns
+// nil unless EnableHostStats was called.
+func (proxy *ProxyHttpServer) TopHosts(n int) []HostStat {
+	if proxy.hostStats == nil {
+		return nil
+	}
+	return proxy.hostStats.top(n)
+}
+
+func (s *hostStats) record(req *http.Request, size int64) {
+	host := req.Host
+	if req.Method != http.MethodConnect && req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.hosts[host]
+	if !ok {
+		if len(s.hosts) >= s.max {
+			s.evictLocked()
+		}
+		st = &HostStat{Host: host}
+		s.hosts[host] = st
+	}
+	st.Requests++
+	if size > 0 {
+		st.Bytes += size
+	}
+}
+
+func (s *hostStats) evictLocked() {
+	var victim *HostStat
+	for _, st := range s.hosts {
+		if victim == nil || hostStatLess(st, victim) {
+			victim = st
+		}
+	}
+	if victim != nil {
+		delete(s.hosts, victim.Host)
+	}
+}
+
+func (s *hostStats) top(n int) []HostStat {
+	s.mu.Lock()
+	stats := make([]HostStat, 0, len(s.hosts))
+	for _, st := range s.hosts {
+		stats = append(stats, *st)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return hostStatLess(&stats[j], &stats[i]) })
+	if n >= 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+func hostStatLess(a, b *HostStat) bool {
+	if a.Requests != b.Requests {
+		return a.Requests < b.Requests
+	}
+	if a.Bytes != b.Bytes {
+		return a.Bytes < b.Bytes
+	}
+	return a.Host > b.Host
+}
@@ -0,0 +1,71 @@
+package frogproxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestTopHosts(t *testing.T) {
+	traffic := []struct {
+		url   string
+		times int
+	}{
+		{"http://a.example/?size=10", 3},
+		{"http://b.example/?size=100", 3},
+		{"http://c.example:8080/?size=5", 1},
+		{"http://c.example/?size=5", 1},
+		{"http://d.example/?size=10", 2},
+		{"http://e.example/?size=10", 2},
+	}
+	for _, tt := range []struct {
+		name     string
+		maxHosts int
+		n        int
+		want     []frogproxy.HostStat
+	}{
+		{"ranked", 0, -1, []frogproxy.HostStat{
+			{Host: "b.example", Requests: 3, Bytes: 300},
+			{Host: "a.example", Requests: 3, Bytes: 30},
+			{Host: "d.example", Requests: 2, Bytes: 20},
+			{Host: "e.example", Requests: 2, Bytes: 20},
+			{Host: "c.example", Requests: 2, Bytes: 10},
+		}},
+		{"limited", 0, 2, []frogproxy.HostStat{
+			{Host: "b.example", Requests: 3, Bytes: 300},
+			{Host: "a.example", Requests: 3, Bytes: 30},
+		}},
+		// Arriving at the cap evicts the quietest host seen so far.
+		{"bounded", 2, -1, []frogproxy.HostStat{
+			{Host: "b.example", Requests: 3, Bytes: 300},
+			{Host: "e.example", Requests: 2, Bytes: 20},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := frogproxy.NewProxyHttpServer()
+			p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+				size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+				return r, frogproxy.NewResponse(r, frogproxy.ContentTypeText, http.StatusOK, strings.Repeat("x", size))
+			})
+			if got := p.TopHosts(-1); got != nil {
+				t.Fatalf("TopHosts before EnableHostStats = %v, want nil", got)
+			}
+			p.EnableHostStats(tt.maxHosts)
+			c := proxyClient(t, p)
+			for _, tr := range traffic {
+				for i := 0; i < tr.times; i++ {
+					get(t, c, tr.url)
+				}
+			}
+			// The last request is counted after its response is sent.
+			eventually(t, func() bool {
+				return reflect.DeepEqual(p.TopHosts(tt.n), tt.want)
+			}, fmt.Sprintf("TopHosts(%d) never became %+v", tt.n, tt.want))
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package frogproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+func StripHSTS() RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil {
+			return resp
+		}
+		resp.Header.Del("Strict-Transport-Security")
+		for _, name := range cspHeaders {
+			values := resp.Header.Values(name)
+			if len(values) == 0 {
+				continue
+			}
+			resp.Header.Del(name)
+			for _, v := range values {
+				if policy := removeCSPDirective(v, "upgrade-insecure-requests"); policy != "" {
+					resp.Header.Add(name, policy)
+				}
+			}
+		}
+		return resp
+	})
+}
+
+func removeCSPDirective(policy, directive string) string {
+	var kept []string
+	for _, d := range strings.Split(policy, ";") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name := d
+		if i := strings.IndexAny(d, " \t"); i >= 0 {
+			name = d[:i]
+		}
+		if strings.EqualFold(name, directive) {
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return strings.Join(kept, "; ")
+}
@@ -0,0 +1,70 @@
+package frogproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestStripHSTS(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   http.Header
+		want http.Header
+	}{
+		{"hsts only",
+			http.Header{"Strict-Transport-Security": {"max-age=31536000; includeSubDomains"}},
+			http.Header{}},
+		{"csp directive removed",
+			http.Header{"Content-Security-Policy": {"default-src 'self'; upgrade-insecure-requests; img-src *"}},
+			http.Header{"Content-Security-Policy": {"default-src 'self'; img-src *"}}},
+		{"csp directive case and spacing",
+			http.Header{"Content-Security-Policy": {"  Upgrade-Insecure-Requests ;script-src 'none';"}},
+			http.Header{"Content-Security-Policy": {"script-src 'none'"}}},
+		{"csp left with nothing is dropped",
+			http.Header{"Content-Security-Policy": {"upgrade-insecure-requests"}},
+			http.Header{}},
+		{"look-alike directives kept",
+			http.Header{"Content-Security-Policy": {"upgrade-insecure-requests-extra; report-uri /upgrade-insecure-requests"}},
+			http.Header{"Content-Security-Policy": {"upgrade-insecure-requests-extra; report-uri /upgrade-insecure-requests"}}},
+		{"report-only and repeated headers",
+			http.Header{
+				"Strict-Transport-Security":           {"max-age=1"},
+				"Content-Security-Policy":             {"upgrade-insecure-requests", "default-src https:"},
+				"Content-Security-Policy-Report-Only": {"upgrade-insecure-requests; default-src 'self'"},
+			},
+			http.Header{
+				"Content-Security-Policy":             {"default-src https:"},
+				"Content-Security-Policy-Report-Only": {"default-src 'self'"},
+			}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, vs := range tt.in {
+					w.Header()[k] = vs
+				}
+				w.Header().Set("X-Keep", "1")
+			}))
+			defer up.Close()
+			p := frogproxy.NewProxyHttpServer()
+			p.OnResponse().Do(frogproxy.StripHSTS())
+			resp, _ := get(t, proxyClient(t, p), up.URL)
+
+			got := http.Header{}
+			for _, k := range []string{"Strict-Transport-Security", "Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+				if vs := resp.Header.Values(k); len(vs) > 0 {
+					got[k] = vs
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headers = %v, want %v", got, tt.want)
+			}
+			if resp.Header.Get("X-Keep") != "1" {
+				t.Error("unrelated header was stripped")
+			}
+		})
+	}
+}
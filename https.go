@@ -2,7 +2,10 @@ package frogproxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -10,10 +13,12 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectActionLiteral int
@@ -25,34 +30,113 @@ const (
 	ConnectHijack
 )
 
+func (a ConnectActionLiteral) String() string {
+	switch a {
+	case ConnectAccept:
+		return "accept"
+	case ConnectReject:
+		return "reject"
+	case ConnectMitm:
+		return "mitm"
+	case ConnectHijack:
+		return "hijack"
+	}
+	return "unknown(" + strconv.Itoa(int(a)) + ")"
+}
+
 type ConnectAction struct {
 	Action    ConnectActionLiteral
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
+	Response  *http.Response
+	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
+	Reason    string
 }
 
 var (
-	OKConnect   = &ConnectAction{Action: ConnectAccept, TLSConfig: TLSConfigFromCA(&FrogproxyCa)}
-	MitmConnect = &ConnectAction{Action: ConnectMitm, TLSConfig: TLSConfigFromCA(&FrogproxyCa)}
-	httpRegexp  = regexp.MustCompile(`^https:\/\/`)
+	OKConnect     = &ConnectAction{Action: ConnectAccept, TLSConfig: tlsConfigFromProxyCA}
+	MitmConnect   = &ConnectAction{Action: ConnectMitm, TLSConfig: tlsConfigFromProxyCA}
+	RejectConnect = &ConnectAction{Action: ConnectReject}
+	httpRegexp    = regexp.MustCompile(`^https:\/\/`)
 )
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) {
-	if _, err := io.Copy(dst, src); err != nil {
+func Mitm() *ConnectAction {
+	return &ConnectAction{Action: ConnectMitm, TLSConfig: tlsConfigFromProxyCA}
+}
+
+func MitmConnectWith(tlsConfigFunc func(host string, ctx *ProxyCtx) (*tls.Config, error)) *ConnectAction {
+	return Mitm().WithTLSConfig(tlsConfigFunc)
+}
+
+func Reject() *ConnectAction {
+	return &ConnectAction{Action: ConnectReject}
+}
+
+// RejectConnectWithReason rejects the CONNECT with status, sending reason to
+// the client as the response body and recording it in the proxy log.
+func RejectConnectWithReason(status int, reason string) *ConnectAction {
+	return &ConnectAction{
+		Action:   ConnectReject,
+		Response: &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1},
+		Reason:   reason,
+	}
+}
+
+// AcceptConnectWithStatus accepts the CONNECT like OKConnect but answers
+// with the given 2xx status and reason instead of 200 Connection established.
+// An empty reason uses the standard status text; a status outside 2xx is
+// ignored with a warning.
+func AcceptConnectWithStatus(status int, reason string) *ConnectAction {
+	if reason == "" {
+		reason = http.StatusText(status)
+	}
+	return OKConnect.WithResponse(&http.Response{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + reason,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	})
+}
+
+func Hijack(fn func(req *http.Request, client net.Conn, ctx *ProxyCtx)) *ConnectAction {
+	return &ConnectAction{Action: ConnectHijack, Hijack: fn}
+}
+
+func (a *ConnectAction) WithTLSConfig(fn func(host string, ctx *ProxyCtx) (*tls.Config, error)) *ConnectAction {
+	action := *a
+	action.TLSConfig = fn
+	return &action
+}
+
+func (a *ConnectAction) WithResponse(resp *http.Response) *ConnectAction {
+	action := *a
+	action.Response = resp
+	return &action
+}
+
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup, n *int64) {
+	var err error
+	if *n, err = io.Copy(dst, src); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 	dst.CloseWrite()
-	src.CloseWrite()
+	src.CloseRead()
+	wg.Done()
 }
 
-func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup, n *int64) {
+	var err error
+	if *n, err = io.Copy(dst, src); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 	wg.Done()
 }
 
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	errStr := fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text-plain\r\nContent-Length:%d\r\n\r\n%s", len(err.Error()), err.Error())
+	httpErrorStatus(w, ctx, http.StatusBadGateway, err)
+}
+
+func httpErrorStatus(w io.WriteCloser, ctx *ProxyCtx, status int, err error) {
+	errStr := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text-plain\r\nContent-Length:%d\r\n\r\n%s", status, http.StatusText(status), len(err.Error()), err.Error())
 	if _, err := io.WriteString(w, errStr); err != nil {
 		ctx.Warnf("Error respoding to client: %s", err)
 	}
@@ -61,6 +145,157 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	}
 }
 
+func statusLine(resp *http.Response) string {
+	text := resp.Status
+	statusCode := strconv.Itoa(resp.StatusCode)
+	text = strings.TrimPrefix(text, statusCode)
+	if text != "" && text[0] != ' ' {
+		text = " " + text
+	}
+	return "HTTP/1.1 " + statusCode + text + "\r\n"
+}
+
+func connectEstablished(ctx *ProxyCtx, todo *ConnectAction) []byte {
+	resp := todo.Response
+	if resp == nil {
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ctx.Warnf("Ignoring non 2xx status %d for accepted CONNECT", resp.StatusCode)
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	copied := *resp
+	if copied.Status == "" {
+		copied.Status = http.StatusText(copied.StatusCode)
+	}
+	var b bytes.Buffer
+	b.WriteString(statusLine(&copied))
+	resp.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func (proxy *ProxyHttpServer) writeMitmResponse(w io.Writer, resp *http.Response, body []byte, buffered, closeConn bool) (written int64, err error) {
+	if _, err = io.WriteString(w, statusLine(resp)); err != nil {
+		return 0, fmt.Errorf("Cannot write TLS response HTTP status from mitm'd client %v", err)
+	}
+
+	noBody := !bodyAllowed(resp)
+	// A zero ContentLength is only trusted when there is no body, since
+	// handler built responses often leave it unset.
+	sized := !buffered && !noBody && (resp.ContentLength > 0 ||
+		resp.ContentLength == 0 && (resp.Body == nil || resp.Body == http.NoBody))
+	if noBody {
+		resp.Header.Del("Transfer-Encoding")
+		if resp.StatusCode == http.StatusNoContent || resp.StatusCode < 200 {
+			resp.Header.Del("Content-Length")
+		}
+	} else if buffered {
+		resp.Header.Del("Transfer-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if !buffered {
+		if sized {
+			resp.Header.Del("Transfer-Encoding")
+			resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		} else if !noBody {
+			resp.Header.Del("Content-Length")
+			resp.Header.Set("Transfer-Encoding", "chunked")
+			if len(resp.Trailer) > 0 {
+				keys := make([]string, 0, len(resp.Trailer))
+				for k := range resp.Trailer {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				resp.Header.Set("Trailer", strings.Join(keys, ", "))
+			}
+		}
+	}
+	resp.Header.Del("Connection")
+	if closeConn {
+		resp.Header.Set("Connection", "close")
+	}
+	if err = resp.Header.Write(w); err != nil {
+		return 0, fmt.Errorf("Cannot write TLS response header from mitm'd client: %v", err)
+	}
+	if _, err = io.WriteString(w, "\r\n"); err != nil {
+		return 0, fmt.Errorf("Cannot write TLS response header from mitm'd client: %v", err)
+	}
+
+	if noBody {
+		return 0, nil
+	}
+	if buffered {
+		n, err := w.Write(body)
+		if err != nil {
+			return int64(n), fmt.Errorf("Cannot write TLS response body from mitm'd client: %v", err)
+		}
+		return int64(n), nil
+	}
+	if sized {
+		if resp.Body == nil {
+			return 0, nil
+		}
+		written, err = proxy.copyResponse(w, io.LimitReader(resp.Body, resp.ContentLength))
+		if err == nil && written < resp.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return written, fmt.Errorf("Cannot write TLS response body from mitm'd client: %v", err)
+		}
+		return written, nil
+	}
+	chunked := newChunkedWriter(w)
+	if written, err = proxy.copyResponse(chunked, resp.Body); err != nil {
+		return written, fmt.Errorf("Cannot write TLS response body from mitm'd client: %v", err)
+	}
+	if err = chunked.Close(); err != nil {
+		return written, fmt.Errorf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
+	}
+	if err = resp.Trailer.Write(w); err != nil {
+		return written, fmt.Errorf("Cannot write TLS chunked trailer from mitm'd client: %v", err)
+	}
+	if _, err = io.WriteString(w, "\r\n"); err != nil {
+		return written, fmt.Errorf("Cannot write TLS chunked trailer from mitm'd client: %v", err)
+	}
+	return written, nil
+}
+
+// DefaultMaxResponseBuffer caps the body BufferResponses will hold when
+// MaxResponseBuffer is zero.
+var DefaultMaxResponseBuffer int64 = 10 << 20
+
+// bufferResponse reads the body of resp so it can be sent with a
+// Content-Length. A body over the buffer limit is streamed instead, with
+// the bytes already read put back in front of the rest.
+func (proxy *ProxyHttpServer) bufferResponse(ctx *ProxyCtx, resp *http.Response) (body []byte, buffered bool, err error) {
+	max := proxy.MaxResponseBuffer
+	if max <= 0 {
+		max = DefaultMaxResponseBuffer
+	}
+	if resp.ContentLength > max {
+		ctx.Logf("Response body of %d bytes exceeds %d, streaming it", resp.ContentLength, max)
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > max {
+		ctx.Logf("Response body exceeds %d bytes, streaming it", max)
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+func bodyAllowed(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
 func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
 	if proxy.Tr.Dial != nil {
 		return proxy.Tr.Dial(network, addr)
@@ -69,6 +304,9 @@ func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error)
 }
 
 func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	if proxy.ConnectDialContext != nil {
+		return proxy.ConnectDialContext(ctx.Req.Context(), network, addr)
+	}
 	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
 		return proxy.dial(network, addr)
 	}
@@ -78,6 +316,65 @@ func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (
 	return proxy.ConnectDial(network, addr)
 }
 
+// DefaultMitmHandshakeTimeout bounds a MITM client TLS handshake, including
+// any wait for a MaxConcurrentHandshakes slot, when MitmHandshakeTimeout
+// is zero.
+var DefaultMitmHandshakeTimeout = 10 * time.Second
+
+func (proxy *ProxyHttpServer) mitmHandshakeTimeout() time.Duration {
+	if proxy.MitmHandshakeTimeout > 0 {
+		return proxy.MitmHandshakeTimeout
+	}
+	return DefaultMitmHandshakeTimeout
+}
+
+// acquireHandshake waits until fewer than MaxConcurrentHandshakes
+// handshakes are running. It gives up at deadline and reports false.
+// The limit is read on every call, so it can be changed at any time.
+func (proxy *ProxyHttpServer) acquireHandshake(deadline time.Time) (release func(), ok bool) {
+	for {
+		limit := proxy.MaxConcurrentHandshakes
+		proxy.state.handshakeMu.Lock()
+		if limit <= 0 || proxy.state.handshakes < limit {
+			proxy.state.handshakes++
+			proxy.state.handshakeMu.Unlock()
+			return proxy.releaseHandshake, true
+		}
+		if proxy.state.handshakeFreed == nil {
+			proxy.state.handshakeFreed = make(chan struct{})
+		}
+		freed := proxy.state.handshakeFreed
+		proxy.state.handshakeMu.Unlock()
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-freed:
+			timer.Stop()
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
+
+func (proxy *ProxyHttpServer) releaseHandshake() {
+	proxy.state.handshakeMu.Lock()
+	proxy.state.handshakes--
+	if proxy.state.handshakeFreed != nil {
+		close(proxy.state.handshakeFreed)
+		proxy.state.handshakeFreed = nil
+	}
+	proxy.state.handshakeMu.Unlock()
+}
+
+// nextMitmRequest waits for a MITM'd client to start its next request and
+// reports whether it did. The connection counts as idle meanwhile, so a
+// Shutdown closes it rather than waiting for a request that may never come.
+func (proxy *ProxyHttpServer) nextMitmRequest(c net.Conn, br *bufio.Reader) bool {
+	proxy.state.tracker.setIdle(c, true)
+	defer proxy.state.tracker.setIdle(c, false)
+	return !isEof(br)
+}
+
 type halfClosable interface {
 	net.Conn
 	CloseWrite() error
@@ -85,8 +382,6 @@ type halfClosable interface {
 }
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
-
 	hij, ok := w.(http.Hijacker)
 	if !ok {
 		panic("httpserver does not support hijacking")
@@ -97,6 +392,22 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		panic("Cannot hijack connection " + e.Error())
 	}
 
+	proxy.handleConnect(r, proxyClient)
+}
+
+func (proxy *ProxyHttpServer) handleConnect(r *http.Request, proxyClient net.Conn) {
+	start := time.Now()
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.state.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx.TunnelID = newRequestID()
+	ctx.RequestID = ctx.TunnelID
+	proxy.startSpan(ctx, r, nil)
+	spanHandedOff := false
+	defer func() {
+		if !spanHandedOff {
+			ctx.endSpan(0, 0)
+		}
+	}()
+
 	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
 
 	todo, host := OKConnect, r.URL.Host
@@ -109,62 +420,205 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			break
 		}
 	}
+	ctx.ConnectAction = todo
+	ctx.Logf("CONNECT %s action=%s", host, todo.Action)
+	if proxy.OnConnectAction != nil {
+		proxy.OnConnectAction(host, todo.Action, ctx)
+	}
 
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
-		if err != nil {
-			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
-			httpError(proxyClient, ctx, err)
+		var targetSiteCon net.Conn
+		var err error
+		if proxy.TunnelRouter != nil {
+			// The SNI is only sent once the client has its 200, so the
+			// router runs first and the CONNECT host is dialed only when
+			// the router keeps it.
+			ctx.Logf("Accepting CONNECT to %s", host)
+			proxyClient.Write(connectEstablished(ctx, todo))
+			sni, hello := peekClientHello(proxyClient, TunnelRouterPeekTimeout)
+			if upstream := proxy.TunnelRouter(sni, host); upstream != "" && upstream != host {
+				ctx.Logf("Routing tunnel for SNI %q from %s to %s", sni, host, upstream)
+				host = upstream
+			}
+			if targetSiteCon, err = proxy.connectDial(ctx, "tcp", host); err != nil {
+				ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+				if isClientHello(hello) {
+					proxyClient.Write(tlsInternalErrorAlert)
+				}
+				proxyClient.Close()
+				proxy.logAccess(r, http.StatusBadGateway, 0, start)
+				return
+			}
+			if _, err := targetSiteCon.Write(hello); err != nil {
+				ctx.Warnf("Cannot replay client hello to %s: %v", host, err)
+				targetSiteCon.Close()
+				proxyClient.Close()
+				return
+			}
+		} else {
+			if targetSiteCon, err = proxy.connectDial(ctx, "tcp", host); err != nil {
+				ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+				httpError(proxyClient, ctx, err)
+				proxy.logAccess(r, http.StatusBadGateway, 0, start)
+				return
+			}
+			ctx.Logf("Accepting CONNECT to %s", host)
+			proxyClient.Write(connectEstablished(ctx, todo))
+		}
+
+		untrack, ok := proxy.state.tracker.track(proxyClient, targetSiteCon)
+		if !ok {
+			targetSiteCon.Close()
+			proxyClient.Close()
 			return
 		}
-		ctx.Logf("Accepting CONNECT to %s", host)
-		proxyClient.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 
-		targetTCP, targetOK := targetSiteCon.(halfClosable)
-		proxyClientTCP, clientOK := proxyClient.(halfClosable)
-		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
-		} else {
-			go func() {
-				var wg sync.WaitGroup
-				wg.Add(2)
-				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
-				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg)
+		_, targetOK := targetSiteCon.(halfClosable)
+		_, clientOK := proxyClient.(halfClosable)
+		if proxy.MaxTunnelBytes > 0 {
+			targetSiteCon, proxyClient = limitTunnel(proxy.MaxTunnelBytes, targetSiteCon, proxyClient)
+		}
+		spanHandedOff = true
+		go func() {
+			var wg sync.WaitGroup
+			var sent, received int64
+			wg.Add(2)
+			if targetOK && clientOK {
+				targetTCP := targetSiteCon.(halfClosable)
+				proxyClientTCP := proxyClient.(halfClosable)
+				go copyAndClose(ctx, targetTCP, proxyClientTCP, &wg, &sent)
+				go copyAndClose(ctx, proxyClientTCP, targetTCP, &wg, &received)
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-			}()
+			} else {
+				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg, &sent)
+				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg, &received)
+				wg.Wait()
+				proxyClient.Close()
+				targetSiteCon.Close()
+			}
+			proxy.logAccess(r, http.StatusOK, sent+received, start)
+			ctx.endSpan(http.StatusOK, sent+received)
+			untrack()
+			if proxy.OnTunnelClose != nil {
+				proxy.OnTunnelClose(host, ctx, sent, received, time.Since(start))
+			}
+		}()
+	case ConnectReject:
+		if todo.Reason != "" {
+			ctx.Warnf("Rejecting CONNECT to %s reason=%q", host, todo.Reason)
+		} else {
+			ctx.Logf("Rejecting CONNECT to %s", host)
+		}
+		resp := NewResponse(r, ContentTypeText, http.StatusForbidden, todo.Reason)
+		if todo.Response != nil {
+			copied := *todo.Response
+			resp = &copied
+			if todo.Reason != "" && resp.Body == nil {
+				resp.Header = resp.Header.Clone()
+				if resp.Header == nil {
+					resp.Header = make(http.Header)
+				}
+				resp.Header.Set("Content-Type", ContentTypeText)
+				resp.Body = io.NopCloser(strings.NewReader(todo.Reason))
+				resp.ContentLength = int64(len(todo.Reason))
+			}
+		}
+		if resp.ProtoMajor == 0 {
+			resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		}
+		if err := resp.Write(proxyClient); err != nil {
+			ctx.Warnf("Cannot write reject response to client: %v", err)
 		}
+		ctx.endSpan(resp.StatusCode, 0)
+		proxyClient.Close()
+		proxy.logAccess(r, resp.StatusCode, 0, start)
+	case ConnectHijack:
+		if todo.Hijack == nil {
+			httpError(proxyClient, ctx, errors.New("hijack action without a hijack function"))
+			proxy.logAccess(r, http.StatusBadGateway, 0, start)
+			return
+		}
+		todo.Hijack(r, proxyClient, ctx)
 	case ConnectMitm:
 		proxyClient.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxing it")
 
-		tlsConfig := defaultTLSConfig
+		tlsConfig := proxy.defaultMitmTLSConfig()
 		if todo.TLSConfig != nil {
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
 				httpError(proxyClient, ctx, err)
+				proxy.logAccess(r, http.StatusBadGateway, 0, start)
 				return
 			}
 		}
 
+		// Go enables TCP_NODELAY on accepted TCP connections, but a custom
+		// listener or conn wrapper may have turned it off; MitmNoDelay
+		// makes sure it is on for the interactive MITM session.
+		if proxy.MitmNoDelay {
+			if tcp, ok := proxyClient.(interface{ SetNoDelay(bool) error }); ok {
+				if err := tcp.SetNoDelay(true); err != nil {
+					ctx.Warnf("Cannot set TCP_NODELAY on client connection: %v", err)
+				}
+			}
+		}
+
+		untrack, ok := proxy.state.tracker.track(proxyClient)
+		if !ok {
+			proxyClient.Close()
+			return
+		}
+		spanHandedOff = true
 		go func() {
+			defer untrack()
+			defer ctx.endSpan(http.StatusOK, 0)
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
 			defer rawClientTls.Close()
-			if err := rawClientTls.Handshake(); err != nil {
+			deadline := time.Now().Add(proxy.mitmHandshakeTimeout())
+			release, ok := proxy.acquireHandshake(deadline)
+			if !ok {
+				ctx.Warnf("Cannot handshake client %v: too many concurrent handshakes", r.Host)
+				return
+			}
+			rawClientTls.SetDeadline(deadline)
+			err := rawClientTls.Handshake()
+			release()
+			if err != nil {
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
-			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
+			rawClientTls.SetDeadline(time.Time{})
+			var subRequests int
+			maxLine := proxy.maxRequestLineLength()
+			clientTlsReader := newBufioReader(rawClientTls, maxLine+2)
+			var watcher *clientWatcher
+			defer func() {
+				if watcher != nil {
+					watcher.stop()
+				}
+				putBufioReader(clientTlsReader)
+			}()
+			for proxy.nextMitmRequest(proxyClient, clientTlsReader) {
+				if requestLineTooLong(clientTlsReader, maxLine) {
+					ctx.Warnf("Request line from mitm'd client %v exceeds %d bytes", r.Host, maxLine)
+					writeURITooLong(rawClientTls)
+					return
+				}
 				req, err := http.ReadRequest(clientTlsReader)
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				clientClose := err == nil && req.Close
+				start := time.Now()
+				subRequests++
+				tunnelSpanCtx := ctx.spanCtx
+				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.state.sess, 1), Proxy: proxy, UserData: ctx.UserData, TunnelID: ctx.TunnelID, ConnectAction: todo}
+				ctx.RequestID = ctx.TunnelID + "-" + strconv.Itoa(subRequests)
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -173,6 +627,11 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 				req.RemoteAddr = r.RemoteAddr
+				clientCtx, cancelClient := context.WithCancel(req.Context())
+				ctx.onDone(cancelClient)
+				watcher = newClientWatcher(rawClientTls, clientTlsReader, cancelClient)
+				req = req.WithContext(clientCtx)
+				req.Body = newDeadlineReader(watcher.watchBody(req.Body), proxy.BodyReadTimeout, rawClientTls.SetReadDeadline)
 				ctx.Logf("req %v", r.Host)
 
 				if !httpRegexp.MatchString(req.URL.String()) {
@@ -180,8 +639,18 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				}
 
 				ctx.Req = req
+				proxy.startSpan(ctx, req, tunnelSpanCtx)
 
-				req, resp := proxy.filterRequest(req, ctx)
+				var resp *http.Response
+				if err == nil && proxy.hostMismatch(ctx, req) {
+					resp = hostMismatchResponse(req)
+				} else {
+					req, resp = proxy.filterRequest(req, ctx)
+				}
+				cancelRoundTrip := context.CancelFunc(func() {})
+				if resp == nil && err == nil && proxy.ambiguousFraming(ctx, req.Header, req.TransferEncoding) {
+					resp = ambiguousFramingResponse(req, http.StatusBadRequest)
+				}
 				if resp == nil {
 					if err != nil {
 						if req.URL != nil {
@@ -189,62 +658,110 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						} else {
 							ctx.Warnf("Illegal URL %s", "https://"+r.Host)
 						}
+						ctx.endSpan(0, 0)
+						ctx.done()
 						return
 					}
+					upgrade := isWebSocketUpgrade(req.Header)
 					removeProxyHeaders(ctx, req)
+					if upgrade {
+						req.Header.Set("Connection", "Upgrade")
+					}
+					if proxy.AddXForwardedProto {
+						req.Header.Set("X-Forwarded-Proto", "https")
+					}
+					proxy.injectSpan(ctx, req.Header)
+					reqBody := proxy.recordRequestBody(req)
 					resp, err = func() (*http.Response, error) {
 						defer req.Body.Close()
-						return ctx.Proxy.Tr.RoundTrip(req)
+						if proxy.RoundTripTimeout > 0 {
+							rtCtx, cancel := context.WithTimeout(req.Context(), proxy.RoundTripTimeout)
+							cancelRoundTrip = cancel
+							return ctx.RoundTrip(req.WithContext(rtCtx))
+						}
+						return ctx.RoundTrip(req)
 					}()
+					ctx.ReqBody = reqBody.bytes()
 					if err != nil {
+						err = proxy.upstreamTLSVersionError(req, err)
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-						return
+						ctx.Error = err
+					} else {
+						ctx.Logf("resp %v", resp.Status)
+						// An upgraded connection may sit idle for long
+						// stretches; BodyReadTimeout only bounds bodies.
+						if resp.StatusCode != http.StatusSwitchingProtocols {
+							resp.Body = newDeadlineReader(resp.Body, proxy.BodyReadTimeout, nil)
+						}
 					}
-					ctx.Logf("resp %v", resp.Status)
+				}
+				if resp != nil {
+					ctx.origBody = resp.Body
 				}
 				resp = proxy.filterResponse(resp, ctx)
-				defer resp.Body.Close()
-
-				text := resp.Status
-				statusCode := strconv.Itoa(resp.StatusCode)
-				text = strings.TrimPrefix(text, statusCode)
-				if _, err := io.WriteString(rawClientTls, "HTTP/1.1 "+statusCode+text+"\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client %v", err)
+				if resp == nil {
+					if ctx.Error == nil {
+						ctx.Error = errors.New("response is nil")
+					}
+					status := http.StatusBadGateway
+					if isTimeout(ctx.Error) {
+						status = http.StatusGatewayTimeout
+					}
+					httpErrorStatus(rawClientTls, ctx, status, ctx.Error)
+					ctx.endSpan(status, 0)
+					ctx.done()
 					return
 				}
-
-				if resp.Request.Method == "HEAD" {
-				} else {
-					resp.Header.Del("Content-Length")
-					resp.Header.Set("Transfer-Encoding", "chunked")
-				}
-				resp.Header.Set("Connection", "close")
-				if err := resp.Header.Write(rawClientTls); err != nil {
-					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
+				if resp.StatusCode == http.StatusSwitchingProtocols && resp.Header.Get("Upgrade") != "" {
+					defer cancelRoundTrip()
+					watcher.stop()
+					written := proxy.tunnelUpgrade(ctx, rawClientTls, clientTlsReader, resp)
+					proxy.logAccess(req, resp.StatusCode, written, start)
+					ctx.endSpan(resp.StatusCode, written)
+					ctx.done()
 					return
 				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
-					return
+				if proxy.ambiguousFraming(ctx, resp.Header, resp.TransferEncoding) {
+					resp.Body.Close()
+					resp = ambiguousFramingResponse(req, http.StatusBadGateway)
 				}
+				if resp.Body != ctx.origBody {
+					resp.ContentLength = -1
+				}
+				resp.Body = proxy.ResponseThrottle.wrap(resp.Body)
 
-				if resp.Request.Method == "HEAD" {
-
-				} else {
-					chunked := newChunkedWriter(rawClientTls)
-					if _, err := io.Copy(chunked, resp.Body); err != nil {
-						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-						return
-					}
-					if err := chunked.Close(); err != nil {
-						ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
-						return
-					}
-					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-						ctx.Warnf("Cannot write TLS chunked trailer from mitm'd client: %v", err)
+				var body []byte
+				var buffered bool
+				if proxy.BufferResponses && bodyAllowed(resp) {
+					if body, buffered, err = proxy.bufferResponse(ctx, resp); err != nil {
+						ctx.Warnf("Cannot buffer TLS response body from mitm'd server: %v", err)
+						resp.Body.Close()
+						httpError(rawClientTls, ctx, err)
+						ctx.endSpan(http.StatusBadGateway, 0)
+						ctx.done()
 						return
 					}
 				}
+
+				written, err := proxy.writeMitmResponse(rawClientTls, resp, body, buffered, clientClose)
+				resp.Body.Close()
+				watcher.stop()
+				cancelRoundTrip()
+				ctx.endSpan(resp.StatusCode, written)
+				if err != nil {
+					ctx.Warnf("%v", err)
+					ctx.done()
+					return
+				}
+				ctx.Logf("Copied %d bytes to client", written)
+				proxy.logAccess(req, resp.StatusCode, written, start)
+				ctx.done()
+				if clientClose {
+					return
+				}
+				// Drain what a handler left unread so the next request
+				// starts at a message boundary.
+				req.Body.Close()
 			}
 			ctx.Logf("Exiting on EOF")
 		}()
@@ -258,86 +775,70 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(net
 }
 
 func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy string, connectReqHandler func(req *http.Request)) func(network, addr string) (net.Conn, error) {
+	var reqHandler func(clientReq, connectReq *http.Request)
+	if connectReqHandler != nil {
+		reqHandler = func(_, connectReq *http.Request) {
+			connectReqHandler(connectReq)
+		}
+	}
+	dial := proxy.NewConnectDialToProxyWithReqHandler(https_proxy, reqHandler)
+	if dial == nil {
+		return nil
+	}
+	return func(network, addr string) (net.Conn, error) {
+		return dial(nil, network, addr)
+	}
+}
+
+func (proxy *ProxyHttpServer) NewConnectDialToProxyWithReqHandler(https_proxy string, connectReqHandler func(clientReq, connectReq *http.Request)) func(req *http.Request, network, addr string) (net.Conn, error) {
 	u, err := url.Parse(https_proxy)
 	if err != nil {
 		return nil
 	}
-	if u.Scheme == "" || u.Scheme == "http" {
-		if !strings.ContainsRune(u.Host, ':') {
-			u.Host += ":80"
+	var defaultPort string
+	switch u.Scheme {
+	case "", "http":
+		defaultPort = ":80"
+	case "https", "wss":
+		defaultPort = ":443"
+	default:
+		return nil
+	}
+	if !strings.ContainsRune(u.Host, ':') {
+		u.Host += defaultPort
+	}
+	return func(req *http.Request, network, addr string) (net.Conn, error) {
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
 		}
-		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			connectReq.Write(c)
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				resp, err := io.ReadAll(resp.Body)
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("Proxy refused connection " + string(resp))
-			}
-			return c, nil
+		if connectReqHandler != nil {
+			connectReqHandler(req, connectReq)
 		}
-	}
-	if u.Scheme == "https" || u.Scheme == "wss" {
-		if !strings.ContainsRune(u.Host, ':') {
-			u.Host += ":443"
+		c, err := proxy.dial(network, u.Host)
+		if err != nil {
+			return nil, err
 		}
-		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			connectReq.Write(c)
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
+		connectReq.Write(c)
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			resp, err := io.ReadAll(resp.Body)
 			if err != nil {
-				c.Close()
 				return nil, err
 			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				resp, err := io.ReadAll(resp.Body)
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("Proxy refused connection " + string(resp))
-			}
-
-			return c, nil
+			c.Close()
+			return nil, errors.New("Proxy refused connection " + string(resp))
 		}
+		return c, nil
 	}
-	return nil
 }
 
 func stripPort(s string) string {
@@ -361,29 +862,166 @@ func stripPort(s string) string {
 
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 	return func(host string, ctx *ProxyCtx) (*tls.Config, error) {
-		var err error
-		var cert *tls.Certificate
-
 		hostname := stripPort(host)
 		config := defaultTLSConfig.Clone()
-		ctx.Logf("signing cert for %s", hostname)
-
-		genCert := func() (*tls.Certificate, error) {
-			return signHost(*ca, []string{hostname})
+		if ctx.Proxy != nil {
+			config = ctx.Proxy.defaultMitmTLSConfig().Clone()
 		}
-		if ctx.certStore != nil {
-			cert, err = ctx.certStore.Fetch(hostname, genCert)
-		} else {
+		// Sign for the SNI the client actually sent, which may differ from
+		// the CONNECT host, e.g. when connecting by IP or domain fronting.
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return signHostFor(ca, hello.ServerName, ctx)
+			}
+			return signHostFor(ca, hostname, ctx)
+		}
+		return config, nil
+	}
+}
+
+func signHostFor(ca *tls.Certificate, hostname string, ctx *ProxyCtx) (cert *tls.Certificate, err error) {
+	if ctx.Proxy != nil && ctx.Proxy.WildcardCerts {
+		hostname = wildcardHost(hostname)
+	}
+	ctx.Logf("signing cert for %s", hostname)
+
+	genCert := func() (*tls.Certificate, error) {
+		return signHost(*ca, []string{hostname})
+	}
+	if ctx.certStore != nil {
+		cert, err = ctx.certStore.Fetch(hostname, genCert)
+		if err == nil && !signedBy(cert, ca) {
+			ctx.Logf("cached cert for %s was signed by another CA, regenerating", hostname)
 			cert, err = genCert()
 		}
+	} else {
+		cert, err = genCert()
+	}
+
+	if err != nil {
+		ctx.Warnf("Cannot sign host certificate with provided CA: %s", err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// wildcardHost returns *.example.com for a.example.com. Hosts with fewer
+// than three labels and IPs are returned unchanged, since a wildcard
+// directly under a TLD is not accepted by clients.
+func wildcardHost(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 {
+		return host
+	}
+	return "*." + strings.Join(labels[1:], ".")
+}
+
+func (proxy *ProxyHttpServer) upstreamTransport(ctx *ProxyCtx) *http.Transport {
+	minVersion := proxy.UpstreamMinTLSVersion
+	if len(ctx.UpstreamALPN) == 0 && minVersion == 0 && proxy.VerifyUpstreamCertificate == nil {
+		return proxy.Tr
+	}
+	key := strings.Join(ctx.UpstreamALPN, ",") + "|" + strconv.Itoa(int(minVersion))
+	if tr, ok := proxy.state.upstreamTransports.Load(key); ok {
+		return tr.(*http.Transport)
+	}
+	tr := proxy.Tr.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	if len(ctx.UpstreamALPN) > 0 {
+		tr.TLSClientConfig.NextProtos = append([]string(nil), ctx.UpstreamALPN...)
+		tr.ForceAttemptHTTP2 = false
+		for _, proto := range ctx.UpstreamALPN {
+			if proto == "h2" {
+				tr.ForceAttemptHTTP2 = true
+			}
+		}
+	}
+	if minVersion > tr.TLSClientConfig.MinVersion {
+		tr.TLSClientConfig.MinVersion = minVersion
+	}
+	if verify := proxy.VerifyUpstreamCertificate; verify != nil {
+		verifyConnection := tr.TLSClientConfig.VerifyConnection
+		tr.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verifyConnection != nil {
+				if err := verifyConnection(cs); err != nil {
+					return err
+				}
+			}
+			rawCerts := make([][]byte, len(cs.PeerCertificates))
+			for i, cert := range cs.PeerCertificates {
+				rawCerts[i] = cert.Raw
+			}
+			return verify(rawCerts, cs.ServerName)
+		}
+	}
+	actual, _ := proxy.state.upstreamTransports.LoadOrStore(key, tr)
+	return actual.(*http.Transport)
+}
 
+// isProtocolVersionAlert reports whether err is a TLS handshake failure
+// over the protocol version. crypto/tls only wraps tls.AlertError for QUIC;
+// over TCP, a protocol_version alert from the server and the client's own
+// rejection of the version the server picked are only told apart by text.
+func isProtocolVersionAlert(err error) bool {
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return alertErr == 70 // protocol_version
+	}
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "tls: protocol version not supported") ||
+		strings.Contains(msg, "tls: server selected unsupported protocol version")
+}
+
+// upstreamTLSVersionError explains a handshake that failed because the
+// upstream doesn't support UpstreamMinTLSVersion.
+func (proxy *ProxyHttpServer) upstreamTLSVersionError(req *http.Request, err error) error {
+	if err == nil || proxy.UpstreamMinTLSVersion == 0 {
+		return err
+	}
+	if !isProtocolVersionAlert(err) {
+		return err
+	}
+	return fmt.Errorf("upstream %s does not support %s or later: %w", req.URL.Host, tls.VersionName(proxy.UpstreamMinTLSVersion), err)
+}
+
+func tlsConfigFromProxyCA(host string, ctx *ProxyCtx) (*tls.Config, error) {
+	return TLSConfigFromCA(ctx.Proxy.mitmCA())(host, ctx)
+}
+
+// MitmCertChain returns the leaf and CA certificates MitmConnect would
+// present to a client connecting to host, without opening a connection.
+func (proxy *ProxyHttpServer) MitmCertChain(host string) ([]*x509.Certificate, error) {
+	ctx := &ProxyCtx{Proxy: proxy, certStore: proxy.CertStore}
+	config, err := tlsConfigFromProxyCA(host, ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for _, der := range cert.Certificate {
+		cert, err := x509.ParseCertificate(der)
 		if err != nil {
-			ctx.Warnf("Cannot sign host certificate with provided CA: %s", err)
 			return nil, err
 		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
 
-		config.Certificates = append(config.Certificates, *cert)
-		return config, nil
-
+func signedBy(cert *tls.Certificate, ca *tls.Certificate) bool {
+	if len(cert.Certificate) < 2 || len(ca.Certificate) == 0 {
+		return true
 	}
+	return bytes.Equal(cert.Certificate[1], ca.Certificate[0])
 }
@@ -0,0 +1,1396 @@
+package frogproxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// mitmClient starts p with every CONNECT intercepted and returns a client
+// that trusts anything, along with a TLS origin answering "hello world".
+func mitmClient(t *testing.T, p *frogproxy.ProxyHttpServer) (*http.Client, *httptest.Server) {
+	t.Helper()
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Up", "1")
+		io.WriteString(w, "hello world")
+	}))
+	t.Cleanup(up.Close)
+	p.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	ps := httptest.NewServer(p)
+	t.Cleanup(ps.Close)
+	pu, _ := url.Parse(ps.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}, up
+}
+
+// eventually polls cond for up to a second.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	closed chan struct{}
+}
+
+func (c *closeNotifier) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.ReadCloser.Close()
+}
+
+func TestMitmRunsCleanupsPerRequest(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().Do(frogproxy.ReplayableRequestBody(0))
+	c, up := mitmClient(t, p)
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Post(up.URL, "text/plain", strings.NewReader("spilled to disk"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		eventually(t, func() bool {
+			ents, _ := os.ReadDir(dir)
+			return len(ents) == 0
+		}, "spilled request body not removed while the connection is alive")
+	}
+}
+
+func TestMitmClosesResponseBodyPerRequest(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	bodies := make(chan *closeNotifier, 2)
+	p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+		if resp != nil {
+			b := &closeNotifier{resp.Body, make(chan struct{})}
+			resp.Body = b
+			bodies <- b
+		}
+		return resp
+	})
+	c, up := mitmClient(t, p)
+
+	for i := 0; i < 2; i++ {
+		if _, body := get(t, c, up.URL); body != "hello world" {
+			t.Fatalf("got %q", body)
+		}
+		// The client keeps the tunnel open, so a deferred close would
+		// only happen once the connection goes away.
+		select {
+		case <-(<-bodies).closed:
+		case <-time.After(time.Second):
+			t.Fatalf("request %d: response body not closed while the connection is alive", i)
+		}
+	}
+}
+
+// stalledConnect opens a CONNECT tunnel through ps and then never starts
+// the TLS handshake.
+func stalledConnect(t *testing.T, ps string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ps, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	return conn
+}
+
+func TestMitmHandshakeTimeout(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.MitmHandshakeTimeout = 50 * time.Millisecond
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn := stalledConnect(t, ps.URL)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stalled handshake not closed: %v", err)
+	}
+}
+
+func TestMitmHandshakeLimit(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.MaxConcurrentHandshakes = 1
+	p.MitmHandshakeTimeout = 200 * time.Millisecond
+	c, up := mitmClient(t, p)
+	pu, _ := c.Transport.(*http.Transport).Proxy(nil)
+
+	if _, body := get(t, c, up.URL); body != "hello world" {
+		t.Fatalf("got %q", body)
+	}
+	stalled := stalledConnect(t, "http://"+pu.Host)
+
+	start := time.Now()
+	c.Transport.(*http.Transport).CloseIdleConnections()
+	if _, err := c.Get(up.URL); err == nil {
+		t.Fatal("handshake over the limit succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("client over the limit waited %v", d)
+	}
+
+	stalled.Close()
+	if _, body := get(t, c, up.URL); body != "hello world" {
+		t.Fatalf("got %q once the slot was freed", body)
+	}
+}
+
+func connectThrough(t *testing.T, proxyURL, host string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp
+}
+
+func TestTunnelRouterRoutesBySNI(t *testing.T) {
+	def := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "default")
+	}))
+	defer def.Close()
+	routed := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "routed")
+	}))
+	defer routed.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.TunnelRouter = func(sni, host string) string {
+		if sni == "routed.test" {
+			return routed.Listener.Addr().String()
+		}
+		return ""
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	for sni, want := range map[string]string{"routed.test": "routed", "other.test": "default"} {
+		conn, resp := connectThrough(t, ps.URL, def.Listener.Addr().String())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %s", resp.Status)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: "+sni+"\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if string(b) != want {
+			t.Errorf("SNI %s: got %q, want %q", sni, b, want)
+		}
+	}
+}
+
+func TestTunnelRouterFallsBackWhenClientIsSilent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "220 ready\r\n")
+	}()
+
+	defer func(d time.Duration) { frogproxy.TunnelRouterPeekTimeout = d }(frogproxy.TunnelRouterPeekTimeout)
+	frogproxy.TunnelRouterPeekTimeout = 50 * time.Millisecond
+	p := frogproxy.NewProxyHttpServer()
+	gotSNI := make(chan string, 1)
+	p.TunnelRouter = func(sni, host string) string {
+		gotSNI <- sni
+		return ""
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn, resp := connectThrough(t, ps.URL, ln.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	greeting := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatalf("server greeting not relayed: %v", err)
+	}
+	if sni := <-gotSNI; sni != "" {
+		t.Fatalf("router saw SNI %q", sni)
+	}
+}
+
+func TestTunnelRouterDialFailureAlertsClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.TunnelRouter = func(sni, host string) string { return "" }
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn, resp := connectThrough(t, ps.URL, addr)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = tls.Client(conn, &tls.Config{ServerName: "down.test", InsecureSkipVerify: true}).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("handshake through unreachable route: got %v, want an internal error alert", err)
+	}
+}
+
+func TestTunnelRouterSkipsUnresolvableConnectHost(t *testing.T) {
+	routed := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "routed")
+	}))
+	defer routed.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	var mu sync.Mutex
+	var dialed []string
+	p.ConnectDial = func(network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return net.Dial(network, addr)
+	}
+	p.TunnelRouter = func(sni, host string) string {
+		if sni == "routed.test" {
+			return routed.Listener.Addr().String()
+		}
+		return ""
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn, resp := connectThrough(t, ps.URL, "does-not-resolve.invalid:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "routed.test", InsecureSkipVerify: true})
+	io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: routed.test\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "routed" {
+		t.Errorf("got %q, want routed", b)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != routed.Listener.Addr().String() {
+		t.Errorf("dialed %v, want only the routed upstream", dialed)
+	}
+}
+
+func TestVerifyUpstreamCertificate(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello world")
+	}))
+	defer up.Close()
+
+	for _, accept := range []bool{true, false} {
+		p := frogproxy.NewProxyHttpServer()
+		var hosts []string
+		var mu sync.Mutex
+		p.VerifyUpstreamCertificate = func(rawCerts [][]byte, host string) error {
+			mu.Lock()
+			hosts = append(hosts, host)
+			mu.Unlock()
+			if len(rawCerts) == 0 {
+				t.Error("no certificates passed to the verifier")
+			}
+			if !accept {
+				return errors.New("rejected by test verifier")
+			}
+			return nil
+		}
+		c, _ := mitmClient(t, p)
+		// httptest certificates are valid for example.com.
+		p.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, up.Listener.Addr().String())
+		}
+		p.Tr.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		p.Tr.TLSClientConfig.RootCAs.AddCert(up.Certificate())
+
+		resp, body := get(t, c, "https://example.com/")
+		if accept && (resp.StatusCode != http.StatusOK || body != "hello world") {
+			t.Errorf("accepting verifier: got %d %q", resp.StatusCode, body)
+		}
+		if !accept && resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("rejecting verifier: got %d, want 502", resp.StatusCode)
+		}
+		mu.Lock()
+		if len(hosts) == 0 || hosts[0] != "example.com" {
+			t.Errorf("verifier called with hosts %q", hosts)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestMitmBufferResponses(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.BufferResponses = true
+	p.MaxResponseBuffer = 64
+	c, _ := mitmClient(t, p)
+	large := strings.Repeat("x", 1000)
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "hello world"
+		if r.URL.Path == "/large" {
+			body = large
+		}
+		// Flushing forces chunked encoding, so the length is unknown.
+		io.WriteString(w, body[:5])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body[5:])
+	}))
+	defer up.Close()
+
+	resp, body := get(t, c, up.URL+"/small")
+	if body != "hello world" || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("small: got %q with Content-Length %d, want it buffered", body, resp.ContentLength)
+	}
+	resp, body = get(t, c, up.URL+"/large")
+	if body != large {
+		t.Fatalf("large: got %d bytes", len(body))
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("large: Content-Length %d, Transfer-Encoding %v; want chunked streaming", resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+type noDelayConn struct {
+	net.Conn
+	noDelay chan bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay <- noDelay
+	return c.Conn.(*net.TCPConn).SetNoDelay(noDelay)
+}
+
+type noDelayListener struct {
+	net.Listener
+	noDelay chan bool
+}
+
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c.(*net.TCPConn).SetNoDelay(false)
+	return &noDelayConn{c, l.noDelay}, nil
+}
+
+func TestMitmNoDelay(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		p := frogproxy.NewProxyHttpServer()
+		p.MitmNoDelay = enabled
+		c, up := mitmClient(t, p)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &noDelayListener{ln, make(chan bool, 1)}
+		srv := &http.Server{Handler: p}
+		go srv.Serve(l)
+		defer srv.Close()
+		c.Transport.(*http.Transport).Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()})
+
+		if _, body := get(t, c, up.URL); body != "hello world" {
+			t.Fatalf("got %q", body)
+		}
+		select {
+		case v := <-l.noDelay:
+			if !enabled || !v {
+				t.Errorf("MitmNoDelay=%v: SetNoDelay(%v) called", enabled, v)
+			}
+		default:
+			if enabled {
+				t.Error("MitmNoDelay set but TCP_NODELAY not enabled on the client conn")
+			}
+		}
+	}
+}
+
+func TestMitmPipelinedResponsesKeepFraming(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Mix sized and chunked responses of different lengths.
+		body := strings.Repeat(r.URL.Path, len(r.URL.Path)*50)
+		if len(r.URL.Path)%2 == 0 {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	c, _ := mitmClient(t, p)
+	pu, _ := c.Transport.(*http.Transport).Proxy(nil)
+	conn, resp := connectThrough(t, "http://"+pu.Host, up.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+
+	var paths []string
+	for i := 0; i < 20; i++ {
+		paths = append(paths, "/"+strings.Repeat("p", i+1))
+	}
+	go func() {
+		for _, path := range paths {
+			io.WriteString(tlsConn, "GET "+path+" HTTP/1.1\r\nHost: "+up.Listener.Addr().String()+"\r\n\r\n")
+		}
+	}()
+	br := bufio.NewReader(tlsConn)
+	for _, path := range paths {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if want := strings.Repeat(path, len(path)*50); string(b) != want {
+			t.Fatalf("%s: got %d bytes, want %d", path, len(b), len(want))
+		}
+	}
+}
+
+// logBuffer collects proxy log output from concurrent goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Printf(format string, v ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(&b.buf, format, v...)
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAlwaysReject(t *testing.T) {
+	target := echoServer(t)
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest(frogproxy.DstHostIs("blocked.com:443")).HandleConnect(frogproxy.AlwaysReject)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	for _, tt := range []struct {
+		host   string
+		status int
+	}{
+		{"blocked.com:443", http.StatusForbidden},
+		{target, http.StatusOK},
+	} {
+		conn, resp := connectThrough(t, ps.URL, tt.host)
+		if resp.StatusCode != tt.status {
+			t.Errorf("CONNECT %s: got %d, want %d", tt.host, resp.StatusCode, tt.status)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(conn, buf)
+		if tt.status == http.StatusForbidden {
+			// The rejected tunnel is closed rather than left hanging.
+			if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("CONNECT %s: connection still open after reject (err=%v)", tt.host, err)
+			}
+		} else if err != nil || string(buf) != "ping" {
+			t.Errorf("CONNECT %s: echo got %q, %v", tt.host, buf, err)
+		}
+	}
+}
+
+func TestLogLinesCarryRequestIDs(t *testing.T) {
+	plainUp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain")
+	}))
+	defer plainUp.Close()
+
+	logs := &logBuffer{}
+	p := frogproxy.NewProxyHttpServer()
+	p.Verbose = true
+	p.Logger = logs
+	var mu sync.Mutex
+	var ids, tunnels []string
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		mu.Lock()
+		ids = append(ids, ctx.RequestID)
+		tunnels = append(tunnels, ctx.TunnelID)
+		mu.Unlock()
+		ctx.Warnf("handling %s", r.URL.Path)
+		return r, nil
+	})
+	c, up := mitmClient(t, p)
+	get(t, proxyClient(t, p), plainUp.URL+"/plain")
+	get(t, c, up.URL+"/first")
+	get(t, c, up.URL+"/second")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 3 || tunnels[0] != "" || tunnels[1] == "" || tunnels[1] != tunnels[2] {
+		t.Fatalf("request IDs %q, tunnel IDs %q", ids, tunnels)
+	}
+	// MITM sub-requests are numbered under their tunnel's ID.
+	tunnel := tunnels[1]
+	if ids[1] != tunnel+"-1" || ids[2] != tunnel+"-2" {
+		t.Fatalf("sub-request IDs %q, want %s-1 and %s-2", ids[1:], tunnel, tunnel)
+	}
+	known := map[string]bool{ids[0]: true, tunnel: true, ids[1]: true, ids[2]: true}
+	seen := map[string]bool{}
+	lineRe := regexp.MustCompile(`^\[\d{3}\] \[([0-9a-f-]+)\] `)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		m := lineRe.FindStringSubmatch(line)
+		if m == nil || !known[m[1]] {
+			t.Errorf("log line without a known request ID: %q", line)
+			continue
+		}
+		seen[m[1]] = true
+	}
+	for id := range known {
+		if !seen[id] {
+			t.Errorf("no log line for request ID %s", id)
+		}
+	}
+	for i, path := range []string{"/plain", "/first", "/second"} {
+		if !strings.Contains(logs.String(), "["+ids[i]+"] WARN: handling "+path) {
+			t.Errorf("handler log for %s does not carry request ID %s", path, ids[i])
+		}
+	}
+}
+
+func TestRejectConnectWithReason(t *testing.T) {
+	logs := &logBuffer{}
+	p := frogproxy.NewProxyHttpServer()
+	p.Logger = logs
+	p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+		return frogproxy.RejectConnectWithReason(http.StatusUnavailableForLegalReasons, "blocked by policy 7"), host
+	}))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	_, resp := connectThrough(t, ps.URL, "example.com:443")
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons || string(b) != "blocked by policy 7" {
+		t.Fatalf("got %d %q", resp.StatusCode, b)
+	}
+	// The reason is logged even when Verbose is off.
+	if !strings.Contains(logs.String(), `reason="blocked by policy 7"`) {
+		t.Fatalf("reason missing from log: %q", logs.String())
+	}
+}
+
+func TestUpstreamMinTLSVersion(t *testing.T) {
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	up.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	up.StartTLS()
+	defer up.Close()
+
+	for _, tc := range []struct {
+		min    uint16
+		status int
+	}{
+		{tls.VersionTLS12, http.StatusOK},
+		{tls.VersionTLS13, http.StatusBadGateway},
+	} {
+		logs := &logBuffer{}
+		p := frogproxy.NewProxyHttpServer()
+		p.Logger = logs
+		p.UpstreamMinTLSVersion = tc.min
+		c, _ := mitmClient(t, p)
+		resp, _ := get(t, c, up.URL)
+		if resp.StatusCode != tc.status {
+			t.Fatalf("min %s: got %d, want %d", tls.VersionName(tc.min), resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusBadGateway && !strings.Contains(logs.String(), "does not support TLS 1.3 or later") {
+			t.Fatalf("version mismatch not explained: %q", logs.String())
+		}
+	}
+}
+
+func TestConnectDialContext(t *testing.T) {
+	target := echoServer(t)
+	var used []string
+	record := func(name string) func(network, addr string) (net.Conn, error) {
+		return func(network, addr string) (net.Conn, error) {
+			used = append(used, name)
+			return net.Dial(network, addr)
+		}
+	}
+	for _, tt := range []struct {
+		name    string
+		withCtx bool
+		withReq bool
+		plain   bool
+		want    string
+	}{
+		{"context preferred", true, true, true, "context"},
+		{"falls back to request dialer", false, true, true, "req"},
+		{"falls back to plain dialer", false, false, true, "plain"},
+	} {
+		used = nil
+		p := frogproxy.NewProxyHttpServer()
+		if tt.withCtx {
+			p.ConnectDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if ctx == nil || ctx.Err() != nil {
+					t.Errorf("%s: dial context unusable: %v", tt.name, ctx)
+				}
+				return record("context")(network, addr)
+			}
+		}
+		if tt.withReq {
+			p.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+				return record("req")(network, addr)
+			}
+		}
+		if tt.plain {
+			p.ConnectDial = record("plain")
+		}
+		ps := httptest.NewServer(p)
+		_, resp := connectThrough(t, ps.URL, target)
+		ps.Close()
+		if resp.StatusCode != http.StatusOK || len(used) != 1 || used[0] != tt.want {
+			t.Errorf("%s: got %d via %v, want 200 via %s", tt.name, resp.StatusCode, used, tt.want)
+		}
+	}
+
+	// A deadline attached by the dialer surfaces as a failed CONNECT.
+	p := frogproxy.NewProxyHttpServer()
+	p.ConnectDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	if _, resp := connectThrough(t, ps.URL, target); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("timed out dial: got %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestConnectDialToProxyWithReqHandler(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the cascade")
+	}))
+	defer target.Close()
+	targetHost := strings.TrimPrefix(target.URL, "http://")
+
+	seen := make(chan string, 1)
+	parent := frogproxy.NewProxyHttpServer()
+	parent.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+		seen <- ctx.Req.Header.Get("Proxy-Authorization")
+		return frogproxy.OKConnect, host
+	}))
+	ps := httptest.NewServer(parent)
+	defer ps.Close()
+
+	child := frogproxy.NewProxyHttpServer()
+	child.ConnectDialWithReq = child.NewConnectDialToProxyWithReqHandler(ps.URL, func(clientReq, connectReq *http.Request) {
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+clientReq.Header.Get("X-User"))
+	})
+	cs := httptest.NewServer(child)
+	defer cs.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(cs.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+targetHost+" HTTP/1.1\r\nHost: "+targetHost+"\r\nX-User: alice\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	if got := <-seen; got != "Basic alice" {
+		t.Fatalf("parent saw Proxy-Authorization %q", got)
+	}
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+targetHost+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "through the cascade" {
+		t.Fatalf("got %q", b)
+	}
+}
+
+func TestConnectActionBuilders(t *testing.T) {
+	t.Run("mitm with TLS config", func(t *testing.T) {
+		ca := newCA(t, "builder CA")
+		hosts := make(chan string, 1)
+		p := frogproxy.NewProxyHttpServer()
+		// Registered before mitmClient's AlwaysMitm, so it wins.
+		p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.Mitm().WithTLSConfig(func(host string, ctx *frogproxy.ProxyCtx) (*tls.Config, error) {
+				select {
+				case hosts <- host:
+				default:
+				}
+				return frogproxy.TLSConfigFromCA(&ca)(host, ctx)
+			}), host
+		}))
+		c, up := mitmClient(t, p)
+		resp, body := get(t, c, up.URL)
+		if resp.Header.Get("X-Up") != "1" || body != "hello world" {
+			t.Fatalf("got %q", body)
+		}
+		select {
+		case host := <-hosts:
+			if host != strings.TrimPrefix(up.URL, "https://") {
+				t.Fatalf("TLS config built for %q", host)
+			}
+		default:
+			t.Fatal("WithTLSConfig callback was not used")
+		}
+		if frogproxy.MitmConnect.TLSConfig == nil {
+			t.Fatal("WithTLSConfig modified MitmConnect")
+		}
+	})
+
+	t.Run("reject with response", func(t *testing.T) {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.Reject().WithResponse(&http.Response{
+				StatusCode: http.StatusUnavailableForLegalReasons,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"X-Policy": {"7"}},
+			}), host
+		}))
+		ps := httptest.NewServer(p)
+		defer ps.Close()
+		_, resp := connectThrough(t, ps.URL, "example.com:443")
+		if resp.StatusCode != http.StatusUnavailableForLegalReasons || resp.Header.Get("X-Policy") != "7" {
+			t.Fatalf("got %d %v", resp.StatusCode, resp.Header)
+		}
+		if frogproxy.RejectConnect.Response != nil {
+			t.Fatal("WithResponse modified RejectConnect")
+		}
+	})
+
+	t.Run("hijack", func(t *testing.T) {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.Hijack(func(req *http.Request, client net.Conn, ctx *frogproxy.ProxyCtx) {
+				defer client.Close()
+				io.WriteString(client, "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nhijacked")
+			}), host
+		}))
+		ps := httptest.NewServer(p)
+		defer ps.Close()
+		_, resp := connectThrough(t, ps.URL, "example.com:443")
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(b) != "hijacked" {
+			t.Fatalf("got %d %q", resp.StatusCode, b)
+		}
+	})
+}
+
+func TestCopiedBytesLoggedForChunkedResponses(t *testing.T) {
+	payload := strings.Repeat("chunk", 300)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(payload); i += 500 {
+			io.WriteString(w, payload[i:i+500])
+			w.(http.Flusher).Flush()
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	want := fmt.Sprintf("Copied %d bytes to client", len(payload))
+	for _, up := range []*httptest.Server{plain, secure} {
+		logs := &logBuffer{}
+		p := frogproxy.NewProxyHttpServer()
+		p.Verbose = true
+		p.Logger = logs
+		c, _ := mitmClient(t, p)
+		resp, body := get(t, c, up.URL)
+		if body != payload || len(resp.TransferEncoding) == 0 {
+			t.Fatalf("%s: got %d bytes, Transfer-Encoding %v", up.URL, len(body), resp.TransferEncoding)
+		}
+		eventually(t, func() bool { return strings.Contains(logs.String(), want) }, up.URL+": "+want+" not logged")
+	}
+}
+
+func TestUpstreamALPN(t *testing.T) {
+	offered := make(chan []string, 1)
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	up.EnableHTTP2 = true
+	up.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered <- hello.SupportedProtos
+		return nil, nil
+	}}
+	up.StartTLS()
+	defer up.Close()
+
+	for _, tt := range []struct {
+		alpn    []string
+		offered string
+		proto   string
+	}{
+		{nil, "", "HTTP/1.1"},
+		{[]string{"http/1.1"}, "http/1.1", "HTTP/1.1"},
+		{[]string{"h2", "http/1.1"}, "h2,http/1.1", "HTTP/2.0"},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+			ctx.UpstreamALPN = tt.alpn
+			return r, nil
+		})
+		c, _ := mitmClient(t, p)
+		_, body := get(t, c, up.URL)
+		if got := strings.Join(<-offered, ","); got != tt.offered {
+			t.Errorf("ALPN %v: origin was offered %q, want %q", tt.alpn, got, tt.offered)
+		}
+		if body != tt.proto {
+			t.Errorf("ALPN %v: origin spoke %s, want %s", tt.alpn, body, tt.proto)
+		}
+	}
+}
+
+func TestAddXForwardedProto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header.Values("X-Forwarded-Proto"), ","))
+	})
+	plainUp := httptest.NewServer(handler)
+	defer plainUp.Close()
+	tlsUp := httptest.NewTLSServer(handler)
+	defer tlsUp.Close()
+
+	for _, tt := range []struct {
+		mitm    bool
+		enabled bool
+		spoofed string
+		want    string
+	}{
+		{false, true, "", "http"},
+		{true, true, "", "https"},
+		{false, true, "https", "http"},
+		{true, true, "http", "https"},
+		{false, false, "", ""},
+		{true, false, "", ""},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.AddXForwardedProto = tt.enabled
+		c, target := proxyClient(t, p), plainUp.URL
+		if tt.mitm {
+			c, _ = mitmClient(t, p)
+			target = tlsUp.URL
+		}
+		req, _ := http.NewRequest("GET", target, nil)
+		if tt.spoofed != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.spoofed)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.want {
+			t.Errorf("mitm=%v enabled=%v spoofed=%q: origin saw X-Forwarded-Proto %q, want %q", tt.mitm, tt.enabled, tt.spoofed, b, tt.want)
+		}
+	}
+}
+
+func TestSetDefaultMitmTLSConfig(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	custom := &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: suites}
+
+	handshake := func(p *frogproxy.ProxyHttpServer) tls.ConnectionState {
+		t.Helper()
+		ps := httptest.NewServer(p)
+		defer ps.Close()
+		raw, _ := connectThrough(t, ps.URL, "example.com:443")
+		conn := tls.Client(raw, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState()
+	}
+	usesCustom := func(cs tls.ConnectionState) bool {
+		return cs.Version == tls.VersionTLS12 && (cs.CipherSuite == suites[0] || cs.CipherSuite == suites[1])
+	}
+
+	for _, tt := range []struct {
+		name   string
+		setup  func(p *frogproxy.ProxyHttpServer) *frogproxy.ProxyHttpServer
+		custom bool
+	}{
+		{"default", func(p *frogproxy.ProxyHttpServer) *frogproxy.ProxyHttpServer {
+			return p
+		}, false},
+		{"custom", func(p *frogproxy.ProxyHttpServer) *frogproxy.ProxyHttpServer {
+			if err := p.SetDefaultMitmTLSConfig(custom); err != nil {
+				t.Fatal(err)
+			}
+			return p
+		}, true},
+		{"reset", func(p *frogproxy.ProxyHttpServer) *frogproxy.ProxyHttpServer {
+			p.SetDefaultMitmTLSConfig(custom)
+			p.SetDefaultMitmTLSConfig(nil)
+			return p
+		}, false},
+		{"inherited by derived proxy", func(p *frogproxy.ProxyHttpServer) *frogproxy.ProxyHttpServer {
+			p.SetDefaultMitmTLSConfig(custom)
+			return p.Derive()
+		}, true},
+	} {
+		p := tt.setup(frogproxy.NewProxyHttpServer())
+		p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+		cs := handshake(p)
+		if usesCustom(cs) != tt.custom {
+			t.Errorf("%s: negotiated version %x suite %x, custom config in use = %v", tt.name, cs.Version, cs.CipherSuite, !tt.custom)
+		}
+		if len(cs.PeerCertificates) == 0 || cs.PeerCertificates[0].Subject.CommonName != "example.com" {
+			t.Errorf("%s: client was not shown a certificate signed for example.com", tt.name)
+		}
+	}
+
+	// The config is copied: later changes by the caller have no effect.
+	p := frogproxy.NewProxyHttpServer()
+	cfg := custom.Clone()
+	p.SetDefaultMitmTLSConfig(cfg)
+	cfg.MaxVersion = tls.VersionTLS13
+	cfg.CipherSuites = nil
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	if cs := handshake(p); !usesCustom(cs) {
+		t.Errorf("caller's later change leaked in: version %x suite %x", cs.Version, cs.CipherSuite)
+	}
+
+	if err := p.SetDefaultMitmTLSConfig(&tls.Config{Certificates: []tls.Certificate{{}}}); err == nil {
+		t.Error("config with preset Certificates was accepted")
+	}
+}
+
+func TestMitmCertificateFollowsSNI(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	for _, tt := range []struct {
+		connect string
+		sni     string
+		want    string
+	}{
+		{"example.com:443", "example.com", "example.com"},
+		{"example.com:443", "front.example", "front.example"},
+		{"192.0.2.7:443", "backend.example", "backend.example"},
+		// Without SNI the certificate is for the CONNECT host.
+		{"192.0.2.7:443", "", "192.0.2.7"},
+		{"example.com:443", "", "example.com"},
+	} {
+		raw, _ := connectThrough(t, ps.URL, tt.connect)
+		conn := tls.Client(raw, &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("CONNECT %s, SNI %q: %v", tt.connect, tt.sni, err)
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		if err := leaf.VerifyHostname(tt.want); err != nil {
+			t.Errorf("CONNECT %s, SNI %q: %v", tt.connect, tt.sni, err)
+		}
+		if connectHost, _, _ := net.SplitHostPort(tt.connect); connectHost != tt.want && leaf.VerifyHostname(connectHost) == nil {
+			t.Errorf("CONNECT %s, SNI %q: certificate also covers the CONNECT host", tt.connect, tt.sni)
+		}
+		conn.Close()
+	}
+}
+
+func TestMitmRequestLineLimit(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer up.Close()
+	host := strings.TrimPrefix(up.URL, "https://")
+
+	// pathFor returns a path making "GET <path> HTTP/1.1" n bytes long.
+	pathFor := func(n int) string {
+		return "/" + strings.Repeat("a", n-len("GET / HTTP/1.1"))
+	}
+	for _, tt := range []struct {
+		max    int
+		line   int
+		status int
+	}{
+		{100, 100, http.StatusOK},
+		{100, 101, http.StatusRequestURITooLong},
+		{0, frogproxy.DefaultMaxRequestLineLength, http.StatusOK},
+		{0, frogproxy.DefaultMaxRequestLineLength + 1, http.StatusRequestURITooLong},
+		{0, 1 << 20, http.StatusRequestURITooLong},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.MaxRequestLineLength = tt.max
+		p.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+		ps := httptest.NewServer(p)
+
+		raw, _ := connectThrough(t, ps.URL, host)
+		conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.WriteString(conn, "GET "+pathFor(tt.line)+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("max %d, line %d: %v", tt.max, tt.line, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("max %d, line %d: got %d %q, want %d", tt.max, tt.line, resp.StatusCode, body, tt.status)
+		}
+		if tt.status == http.StatusRequestURITooLong {
+			if _, err := br.ReadByte(); err == nil {
+				t.Errorf("max %d, line %d: connection left open after 414", tt.max, tt.line)
+			}
+		}
+		conn.Close()
+		ps.Close()
+	}
+}
+
+func TestAcceptConnectWithStatus(t *testing.T) {
+	target := echoServer(t)
+	for _, tt := range []struct {
+		status int
+		reason string
+		line   string
+	}{
+		{200, "Tunnel ready", "HTTP/1.1 200 Tunnel ready\r\n"},
+		{299, "Custom Thing", "HTTP/1.1 299 Custom Thing\r\n"},
+		{204, "", "HTTP/1.1 204 No Content\r\n"},
+		{302, "Found", "HTTP/1.1 200 Connection established\r\n"},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.AcceptConnectWithStatus(tt.status, tt.reason), host
+		}))
+		ps := httptest.NewServer(p)
+
+		conn, err := net.Dial("tcp", ps.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		if err != nil || line != tt.line {
+			t.Errorf("%d %q: status line %q, %v; want %q", tt.status, tt.reason, line, err, tt.line)
+		}
+		for {
+			if l, err := br.ReadString('\n'); err != nil || l == "\r\n" {
+				break
+			}
+		}
+
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%d %q: tunnel echo got %q, %v", tt.status, tt.reason, buf, err)
+		}
+		conn.Close()
+		ps.Close()
+	}
+}
+
+func TestMitmPreservesTrailers(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/declared":
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		case "/undeclared":
+		default:
+			io.WriteString(w, "no trailers")
+			return
+		}
+		io.WriteString(w, "payload")
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/declared" {
+			w.Header().Set("Grpc-Status", "0")
+			w.Header().Set("Grpc-Message", "done")
+		} else {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "7")
+		}
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	c, _ := mitmClient(t, p)
+	for _, tt := range []struct {
+		path    string
+		body    string
+		trailer http.Header
+	}{
+		{"/declared", "payload", http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"done"}}},
+		{"/undeclared", "payload", http.Header{"Grpc-Status": {"7"}}},
+		{"/none", "no trailers", nil},
+	} {
+		resp, body := get(t, c, up.URL+tt.path)
+		if body != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.path, body, tt.body)
+		}
+		if len(resp.Trailer) == 0 {
+			resp.Trailer = nil
+		}
+		if !reflect.DeepEqual(resp.Trailer, tt.trailer) {
+			t.Errorf("%s: trailer %v, want %v", tt.path, resp.Trailer, tt.trailer)
+		}
+	}
+}
+
+func TestExcludeHostsFromMitm(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	port := up.Listener.Addr().(*net.TCPAddr).Port
+	ipHost := fmt.Sprintf("127.0.0.1:%d", port)
+	nameHost := fmt.Sprintf("localhost:%d", port)
+
+	for _, tt := range []struct {
+		name     string
+		exclude  func(p *frogproxy.ProxyHttpServer)
+		tunneled map[string]bool
+	}{
+		{"by name", func(p *frogproxy.ProxyHttpServer) {
+			p.OnRequest().ExcludeHostsFromMitm("localhost")
+		}, map[string]bool{nameHost: true, ipHost: false}},
+		{"by name and port, any case", func(p *frogproxy.ProxyHttpServer) {
+			p.OnRequest().ExcludeHostsFromMitm("example.com", "LOCALHOST:"+strconv.Itoa(port))
+		}, map[string]bool{nameHost: true, ipHost: false}},
+		{"condition not met", func(p *frogproxy.ProxyHttpServer) {
+			p.OnRequest(frogproxy.SrcIpIs("192.0.2.1")).ExcludeHostsFromMitm("localhost")
+		}, map[string]bool{nameHost: false, ipHost: false}},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+		tt.exclude(p)
+		ps := httptest.NewServer(p)
+		for host, tunneled := range tt.tunneled {
+			raw, _ := connectThrough(t, ps.URL, host)
+			conn := tls.Client(raw, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("%s, %s: %v", tt.name, host, err)
+			}
+			// A tunneled client reaches the origin and sees its certificate.
+			if got := conn.ConnectionState().PeerCertificates[0].Equal(up.Certificate()); got != tunneled {
+				t.Errorf("%s: %s tunneled = %v, want %v", tt.name, host, got, tunneled)
+			}
+			conn.Close()
+		}
+		ps.Close()
+	}
+}
+
+func TestOnConnectAction(t *testing.T) {
+	target := echoServer(t)
+	type recorded struct {
+		host   string
+		action frogproxy.ConnectActionLiteral
+		inCtx  frogproxy.ConnectActionLiteral
+	}
+	for _, tt := range []struct {
+		name    string
+		host    string
+		handler frogproxy.HttpsHandler
+		status  int
+		want    recorded
+	}{
+		{"accept by default", target, nil, http.StatusOK, recorded{target, frogproxy.ConnectAccept, frogproxy.ConnectAccept}},
+		{"reject", target, frogproxy.AlwaysReject, http.StatusForbidden, recorded{target, frogproxy.ConnectReject, frogproxy.ConnectReject}},
+		{"mitm", target, frogproxy.AlwaysMitm, http.StatusOK, recorded{target, frogproxy.ConnectMitm, frogproxy.ConnectMitm}},
+		{"hijack", target, frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.Hijack(func(req *http.Request, client net.Conn, ctx *frogproxy.ProxyCtx) {
+				io.WriteString(client, "HTTP/1.1 200 OK\r\n\r\n")
+				client.Close()
+			}), host
+		}), http.StatusOK, recorded{target, frogproxy.ConnectHijack, frogproxy.ConnectHijack}},
+		{"host rewritten", "rewritten.example:443", frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+			return frogproxy.OKConnect, target
+		}), http.StatusOK, recorded{target, frogproxy.ConnectAccept, frogproxy.ConnectAccept}},
+	} {
+		p := frogproxy.NewProxyHttpServer()
+		got := make(chan recorded, 1)
+		p.OnConnectAction = func(host string, action frogproxy.ConnectActionLiteral, ctx *frogproxy.ProxyCtx) {
+			got <- recorded{host, action, ctx.ConnectAction.Action}
+		}
+		if tt.handler != nil {
+			p.OnRequest().HandleConnect(tt.handler)
+		}
+		ps := httptest.NewServer(p)
+		_, resp := connectThrough(t, ps.URL, tt.host)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: CONNECT answered %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		select {
+		case r := <-got:
+			if r != tt.want {
+				t.Errorf("%s: recorded %+v, want %+v", tt.name, r, tt.want)
+			}
+		default:
+			t.Errorf("%s: OnConnectAction not called", tt.name)
+		}
+		ps.Close()
+	}
+}
+
+func TestMitmClientDisconnectCancelsUpstream(t *testing.T) {
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			select {
+			case <-r.Context().Done():
+				aborted <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer up.Close()
+	p := frogproxy.NewProxyHttpServer()
+	c, _ := mitmClient(t, p)
+
+	// Requests sharing a connection still work: whatever the watcher reads
+	// while waiting for a disconnect is left for the next request.
+	reused := 0
+	for i, body := range []string{"", "first body", "second body"} {
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				reused++
+			}
+		}}
+		req, _ := http.NewRequest("POST", up.URL+"/echo", strings.NewReader(body))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != body {
+			t.Errorf("request %d echoed %q, want %q", i, got, body)
+		}
+	}
+	if reused != 2 {
+		t.Errorf("%d of 2 follow-up requests reused the MITM connection", reused)
+	}
+
+	// A client that hangs up mid-request cancels the upstream fetch.
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", up.URL+"/slow", nil)
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := c.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the origin")
+	}
+	cancel()
+	if err := <-errc; err == nil {
+		t.Error("cancelled request succeeded")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request outlived the client")
+	}
+}
@@ -0,0 +1,81 @@
+package frogproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type oneConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c != nil {
+		return c, nil
+	}
+	<-l.done
+	return nil, errors.New("listener closed")
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func ServeLocalTLS(handler http.Handler, clientCAs *x509.CertPool) *ConnectAction {
+	return Hijack(func(req *http.Request, client net.Conn, ctx *ProxyCtx) {
+		tlsConfig, err := tlsConfigFromProxyCA(req.URL.Host, ctx)
+		if err != nil {
+			httpError(client, ctx, err)
+			return
+		}
+		if clientCAs != nil {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = clientCAs
+		}
+		if _, err := client.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+			ctx.Warnf("Cannot accept local CONNECT: %v", err)
+			client.Close()
+			return
+		}
+		tracker := &ctx.Proxy.state.tracker
+		untrack, ok := tracker.track(client)
+		if !ok {
+			client.Close()
+			return
+		}
+		ctx.Logf("Serving CONNECT to %s locally", req.URL.Host)
+		l := &oneConnListener{conn: tls.Server(client, tlsConfig), done: make(chan struct{})}
+		var closeOnce sync.Once
+		srv := &http.Server{
+			Handler: handler,
+			ConnState: func(_ net.Conn, state http.ConnState) {
+				switch state {
+				case http.StateActive:
+					tracker.setIdle(client, false)
+				case http.StateIdle:
+					tracker.setIdle(client, true)
+				case http.StateClosed, http.StateHijacked:
+					closeOnce.Do(func() {
+						untrack()
+						close(l.done)
+					})
+				}
+			},
+		}
+		go srv.Serve(l)
+	})
+}
@@ -0,0 +1,94 @@
+package frogproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// clientCert returns a self-signed client certificate for name.
+func clientCert(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestServeLocalTLSWithClientCert(t *testing.T) {
+	admin, adminCert := clientCert(t, "admin")
+	stranger, _ := clientCert(t, "stranger")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(adminCert)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest(frogproxy.DstHostIs("portal.internal:443")).HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+		return frogproxy.ServeLocalTLS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "welcome "+r.TLS.PeerCertificates[0].Subject.CommonName+" to "+r.Host)
+		}), clientCAs), host
+	}))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+
+	for _, tc := range []struct {
+		name  string
+		certs []tls.Certificate
+		body  string
+	}{
+		{"trusted", []tls.Certificate{admin}, "welcome admin to portal.internal"},
+		{"untrusted", []tls.Certificate{stranger}, ""},
+		{"missing", nil, ""},
+	} {
+		tr := &http.Transport{
+			Proxy:           http.ProxyURL(pu),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: tc.certs},
+		}
+		resp, err := (&http.Client{Transport: tr}).Get("https://portal.internal/")
+		tr.CloseIdleConnections()
+		if tc.body == "" {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s client certificate: request succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s client certificate: %v", tc.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.body {
+			t.Errorf("%s client certificate: got %q, want %q", tc.name, b, tc.body)
+		}
+	}
+}
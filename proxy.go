@@ -2,28 +2,111 @@ package frogproxy
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ProxyHttpServer struct {
-	sess                   int64
-	KeepDestinationHeaders bool
-	CertStore              CertStorage
-	Verbose                bool
-	Logger                 Logger
-	httpsHandlers          []HttpsHandler
-	ConnectDialWithReq     func(req *http.Request, network string, addr string) (net.Conn, error)
-	ConnectDial            func(network string, addr string) (net.Conn, error)
-	Tr                     *http.Transport
-	reqHandlers            []ReqHandler
-	respHandlers           []RespHandler
-	KeepHeader             bool
+	KeepDestinationHeaders  bool
+	CertStore               CertStorage
+	Verbose                 bool
+	Logger                  Logger
+	httpsHandlers           []HttpsHandler
+	ConnectDialWithReq      func(req *http.Request, network string, addr string) (net.Conn, error)
+	ConnectDial             func(network string, addr string) (net.Conn, error)
+	ConnectDialContext      func(ctx context.Context, network string, addr string) (net.Conn, error)
+	Tr                      *http.Transport
+	reqHandlers             []ReqHandler
+	respHandlers            []RespHandler
+	KeepHeader              bool
+	BodyReadTimeout         time.Duration
+	MaxTunnelBytes          int64
+	BufferResponses         bool
+	MaxResponseBuffer       int64
+	MitmNoDelay             bool
+	GeoIP                   GeoIPResolver
+	RejectAmbiguousFraming  bool
+	TunnelRouter            func(sni, host string) (upstream string)
+	ResponseThrottle        *ThrottleProfile
+	SOCKS5Auth              func(user, password string) bool
+	CopyBufferSize          int
+	BufferRequestBodies     bool
+	MaxRequestBodyBuffer    int64
+	MaxConcurrentHandshakes int
+	MitmHandshakeTimeout    time.Duration
+	AddXForwardedProto      bool
+	HostMismatch            HostMismatchPolicy
+	MaxRequestLineLength    int
+	WildcardCerts           bool
+	UpstreamMinTLSVersion   uint16
+	MaxDecompressedBytes    int64
+	MaxCompressionRatio     int
+	accessLog               *accessLogger
+	hostStats               *hostStats
+	tracer                  TracerProvider
+	state                   *proxyState
+	mitm                    *mitmState
+	parent                  *ProxyHttpServer
+
+	// VerifyUpstreamCertificate is called after the standard verification
+	// of every upstream TLS certificate chain, for plain and MITM'd
+	// requests alike. host is the server name sent in SNI, which is empty
+	// when the upstream is addressed by IP.
+	VerifyUpstreamCertificate func(rawCerts [][]byte, host string) error
+
+	// RoundTripTimeout bounds the whole upstream exchange, from sending the
+	// request through reading the last byte of the response body; a body
+	// still streaming when it expires is cut off. Use BodyReadTimeout to
+	// bound idle gaps in long-lived responses instead.
+	RoundTripTimeout time.Duration
+
+	// OnTunnelClose is called when an accepted CONNECT tunnel has closed in
+	// both directions, with the bytes sent from client to upstream, the
+	// bytes received back and how long the tunnel was open. It is not
+	// called for MITM'd or hijacked connections.
+	OnTunnelClose func(host string, ctx *ProxyCtx, sent, received int64, dur time.Duration)
+
+	// OnConnectAction is called for every CONNECT once the CONNECT handlers
+	// have chosen what to do with it, with the host they settled on. The
+	// action is also kept in ctx.ConnectAction.
+	OnConnectAction func(host string, action ConnectActionLiteral, ctx *ProxyCtx)
+}
+
+// proxyState is the runtime state a proxy shares with every proxy derived
+// from it.
+type proxyState struct {
+	sess               int64
+	copyBufPool        sync.Pool
+	upstreamTransports sync.Map
+	handshakeMu        sync.Mutex
+	handshakes         int
+	handshakeFreed     chan struct{}
+	paused             atomic.Bool
+	tracker            connTracker
+	serverMu           sync.Mutex
+	servers            map[*http.Server]struct{}
+	shutdown           bool
+	listeners          map[net.Listener]struct{}
+}
+
+// mitmState holds the MITM CA and TLS config set on one proxy.
+type mitmState struct {
+	mu        sync.RWMutex
+	ca        *tls.Certificate
+	tlsConfig *tls.Config
 }
 
 type flushWriter struct {
@@ -54,6 +137,31 @@ func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 	}
 }
 
+func (proxy *ProxyHttpServer) copyResponse(dst io.Writer, src io.Reader) (int64, error) {
+	size := proxy.CopyBufferSize
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	bp, _ := proxy.state.copyBufPool.Get().(*[]byte)
+	if bp == nil || len(*bp) != size {
+		buf := make([]byte, size)
+		bp = &buf
+	}
+	defer proxy.state.copyBufPool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 func isEof(r *bufio.Reader) bool {
 	_, err := r.Peek(1)
 	if err == io.EOF {
@@ -78,8 +186,8 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
 	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(r, ctx)
-		if req != nil {
+		req, resp = h.Handle(req, ctx)
+		if resp != nil {
 			break
 		}
 	}
@@ -95,29 +203,119 @@ func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *Proxy
 	return
 }
 
+func (proxy *ProxyHttpServer) handleMaxForwards(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx, start time.Time) bool {
+	if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+		return false
+	}
+	mf := r.Header.Get("Max-Forwards")
+	if mf == "" {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(mf))
+	if err != nil || n < 0 {
+		return false
+	}
+	if n > 0 {
+		r.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+		return false
+	}
+	ctx.Logf("Max-Forwards reached zero, answering %v locally", r.Method)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE, CONNECT")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		proxy.logAccess(r, http.StatusOK, 0, start)
+		return true
+	}
+	dump, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		proxy.logAccess(r, http.StatusInternalServerError, 0, start)
+		return true
+	}
+	w.Header().Set("Content-Type", "message/http")
+	w.Header().Set("Content-Length", strconv.Itoa(len(dump)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(dump)
+	proxy.logAccess(r, http.StatusOK, int64(len(dump)), start)
+	return true
+}
+
+// Pause makes the proxy turn away new requests, CONNECTs and SOCKS5
+// connections with 503 Service Unavailable (a general failure for SOCKS5)
+// while keeping its listeners open. Tunnels and MITM connections already
+// established carry on. Derived proxies are paused too.
+func (proxy *ProxyHttpServer) Pause() {
+	proxy.state.paused.Store(true)
+}
+
+// Resume undoes Pause.
+func (proxy *ProxyHttpServer) Resume() {
+	proxy.state.paused.Store(false)
+}
+
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if proxy.state.paused.Load() {
+		start := time.Now()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "proxy is paused", http.StatusServiceUnavailable)
+		proxy.logAccess(r, http.StatusServiceUnavailable, int64(len("proxy is paused\n")), start)
+		return
+	}
 	if r.Method == "CONNECT" {
 		proxy.handleHttps(w, r)
 	} else {
-		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
+		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.state.sess, 1), Proxy: proxy, RequestID: newRequestID()}
+		defer ctx.done()
+		start := time.Now()
 		var err error
 		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 		if !r.URL.IsAbs() {
+			proxy.logAccess(r, http.StatusOK, 0, start)
+			return
+		}
+		if proxy.handleMaxForwards(w, r, ctx, start) {
 			return
 		}
-		r, resp := proxy.filterRequest(r, ctx)
+		proxy.startSpan(ctx, r, nil)
+		origScheme := r.URL.Scheme
+		r.Body = newDeadlineReader(r.Body, proxy.BodyReadTimeout, http.NewResponseController(w).SetReadDeadline)
+		var resp *http.Response
+		if proxy.hostMismatch(ctx, r) {
+			resp = hostMismatchResponse(r)
+		} else {
+			r, resp = proxy.filterRequest(r, ctx)
+		}
+		if resp == nil && proxy.ambiguousFraming(ctx, r.Header, r.TransferEncoding) {
+			resp = ambiguousFramingResponse(r, http.StatusBadRequest)
+		}
+
+		var upstreamCtx context.Context
+		var cancelUpstream context.CancelFunc
+		if proxy.RoundTripTimeout > 0 {
+			upstreamCtx, cancelUpstream = context.WithTimeout(r.Context(), proxy.RoundTripTimeout)
+		} else {
+			upstreamCtx, cancelUpstream = context.WithCancel(r.Context())
+		}
+		defer cancelUpstream()
 
 		if resp == nil {
 			if !proxy.KeepHeader {
 				removeProxyHeaders(ctx, r)
 			}
-			resp, err = ctx.RoundTrip(r)
+			if proxy.AddXForwardedProto {
+				r.Header.Set("X-Forwarded-Proto", origScheme)
+			}
+			proxy.injectSpan(ctx, r.Header)
+			reqBody := proxy.recordRequestBody(r)
+			resp, err = ctx.RoundTrip(r.WithContext(upstreamCtx))
+			ctx.ReqBody = reqBody.bytes()
 			if err != nil {
-				ctx.Error = err
-				resp = proxy.filterResponse(nil, ctx)
+				ctx.Error = proxy.upstreamTLSVersionError(r, err)
 			}
 			if resp != nil {
 				ctx.Logf("Received response %v", resp.Status)
+				resp.Body = newDeadlineReader(resp.Body, proxy.BodyReadTimeout, nil)
 			}
 		}
 
@@ -126,45 +324,151 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			origBody = resp.Body
 			defer origBody.Close()
 		}
+		ctx.origBody = origBody
 
 		resp = proxy.filterResponse(resp, ctx)
 		if resp == nil {
 			var errorString string
+			status := http.StatusInternalServerError
 			if ctx.Error != nil {
 				errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
 				ctx.Logf(errorString)
-				http.Error(w, ctx.Error.Error(), 500)
+				status = http.StatusBadGateway
+				if isTimeout(ctx.Error) {
+					status = http.StatusGatewayTimeout
+				}
+				http.Error(w, ctx.Error.Error(), status)
 			} else {
 				errorString = "error read response " + r.URL.Host + " : response is nil"
 				ctx.Logf(errorString)
-				http.Error(w, errorString, 500)
+				http.Error(w, errorString, status)
 			}
+			proxy.logAccess(r, status, 0, start)
+			ctx.endSpan(status, 0)
 			return
 		}
+		if proxy.ambiguousFraming(ctx, resp.Header, resp.TransferEncoding) {
+			resp.Body.Close()
+			resp = ambiguousFramingResponse(r, http.StatusBadGateway)
+		}
 		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
-		if origBody != resp.Body {
+		if ctx.origBody != resp.Body {
 			resp.Header.Del("Content-Length")
 		}
 
+		resp.Body = proxy.ResponseThrottle.wrap(resp.Body)
+
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
 		w.WriteHeader(resp.StatusCode)
 		var copyWriter io.Writer = w
 		if w.Header().Get("content-type") == "text/event-stream" {
 			copyWriter = &flushWriter{w: w}
 		}
-		nr, err := io.Copy(copyWriter, resp.Body)
+		nr, err := proxy.copyResponse(copyWriter, resp.Body)
+		if err != nil {
+			ctx.Warnf("Error copying response to client, cancelling upstream: %v", err)
+			cancelUpstream()
+		}
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("error close response body %v", err)
 		}
 		ctx.Logf("Copied %d bytes to client error=%v", nr, err)
+		proxy.logAccess(r, resp.StatusCode, nr, start)
+		ctx.endSpan(resp.StatusCode, nr)
+		if err != nil {
+			// Abort so the client sees a truncated body rather than a
+			// cleanly terminated one.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// SetMitmCa sets the CA used to sign certificates for hosts intercepted by
+// this proxy, in place of the package-level FrogproxyCa. Leaf certificates
+// already in a CertStore that implements CertStorageFlusher are dropped,
+// so no host keeps a certificate signed by the previous CA.
+func (proxy *ProxyHttpServer) SetMitmCa(ca tls.Certificate) {
+	proxy.mitm.mu.Lock()
+	proxy.mitm.ca = &ca
+	proxy.mitm.mu.Unlock()
+	if f, ok := proxy.CertStore.(CertStorageFlusher); ok {
+		f.Flush()
 	}
 }
 
+// SetCA sets the MITM signing CA.
+//
+// Deprecated: use SetMitmCa.
+func (proxy *ProxyHttpServer) SetCA(ca tls.Certificate) {
+	proxy.SetMitmCa(ca)
+}
+
+// SetDefaultMitmTLSConfig sets the TLS config presented to MITM'd clients,
+// e.g. to choose versions, cipher suites or session ticket policy. cfg is
+// copied, and each host gets its own clone with a signed certificate, so
+// cfg must not set Certificates. A nil cfg restores the default, and a
+// derived proxy without its own config uses its parent's.
+func (proxy *ProxyHttpServer) SetDefaultMitmTLSConfig(cfg *tls.Config) error {
+	if cfg != nil && len(cfg.Certificates) > 0 {
+		return errors.New("mitm TLS config must not preset Certificates; they are signed per host")
+	}
+	if cfg != nil {
+		cfg = cfg.Clone()
+	}
+	proxy.mitm.mu.Lock()
+	proxy.mitm.tlsConfig = cfg
+	proxy.mitm.mu.Unlock()
+	return nil
+}
+
+func (proxy *ProxyHttpServer) defaultMitmTLSConfig() *tls.Config {
+	proxy.mitm.mu.RLock()
+	defer proxy.mitm.mu.RUnlock()
+	if proxy.mitm.tlsConfig != nil {
+		return proxy.mitm.tlsConfig
+	}
+	if proxy.parent != nil {
+		return proxy.parent.defaultMitmTLSConfig()
+	}
+	return defaultTLSConfig
+}
+
+func (proxy *ProxyHttpServer) mitmCA() *tls.Certificate {
+	proxy.mitm.mu.RLock()
+	defer proxy.mitm.mu.RUnlock()
+	if proxy.mitm.ca != nil {
+		return proxy.mitm.ca
+	}
+	if proxy.parent != nil {
+		return proxy.parent.mitmCA()
+	}
+	return &FrogproxyCa
+}
+
 func NewProxyHttpServer() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
 		Tr:     &http.Transport{},
 		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		state:  &proxyState{},
+		mitm:   &mitmState{},
 	}
 
 	return &proxy
 }
+
+// Derive returns a copy of proxy with empty request, response and CONNECT
+// handler chains, for serving another listener with different handlers.
+// The copy keeps every setting and shares the transport, access log, host
+// stats and tracer; it uses proxy's MITM CA and TLS config until it sets
+// its own. It also shares proxy's runtime state: the handshake budget of
+// MaxConcurrentHandshakes, Pause and Resume, and the server lifecycle, so
+// Shutdown on either proxy closes the listeners and tunnels of both.
+func (proxy *ProxyHttpServer) Derive() *ProxyHttpServer {
+	derived := *proxy
+	derived.reqHandlers = nil
+	derived.respHandlers = nil
+	derived.httpsHandlers = nil
+	derived.mitm = &mitmState{}
+	derived.parent = proxy
+	return &derived
+}
@@ -0,0 +1,55 @@
+package frogproxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// onlyReader and onlyWriter hide ReadFrom/WriteTo so copies go through
+// the buffer being measured.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func BenchmarkCopyResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	for _, bm := range []struct {
+		name string
+		size int
+		copy func(proxy *ProxyHttpServer, dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"default", 0, (*ProxyHttpServer).copyResponse},
+		{"unpooled-256KB", 256 << 10, func(proxy *ProxyHttpServer, dst io.Writer, src io.Reader) (int64, error) {
+			return io.CopyBuffer(dst, src, make([]byte, proxy.CopyBufferSize))
+		}},
+		{"pooled-32KB", 32 << 10, (*ProxyHttpServer).copyResponse},
+		{"pooled-256KB", 256 << 10, (*ProxyHttpServer).copyResponse},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			proxy := NewProxyHttpServer()
+			proxy.CopyBufferSize = bm.size
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.copy(proxy, onlyWriter{io.Discard}, onlyReader{bytes.NewReader(body)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyResponseBufferSizes(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, size := range []int{0, 7, 32 << 10} {
+		proxy := NewProxyHttpServer()
+		proxy.CopyBufferSize = size
+		for i := 0; i < 2; i++ {
+			var out bytes.Buffer
+			n, err := proxy.copyResponse(onlyWriter{&out}, onlyReader{bytes.NewReader(body)})
+			if err != nil || n != int64(len(body)) || !bytes.Equal(out.Bytes(), body) {
+				t.Fatalf("size %d: copied %d bytes, err %v", size, n, err)
+			}
+		}
+	}
+}
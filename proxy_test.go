@@ -0,0 +1,521 @@
+package frogproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+	"golang.org/x/net/proxy"
+)
+
+// proxyClient starts p behind an httptest server and returns a client that
+// sends every request through it.
+func proxyClient(t *testing.T, p *frogproxy.ProxyHttpServer) *http.Client {
+	t.Helper()
+	ps := httptest.NewServer(p)
+	t.Cleanup(ps.Close)
+	pu, _ := url.Parse(ps.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(pu)}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func get(t *testing.T, c *http.Client, u string) (*http.Response, string) {
+	t.Helper()
+	resp, err := c.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestRequestHandlersChain(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-First")+","+r.Header.Get("X-Second"))
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		r.Header.Set("X-First", "1")
+		return r, nil
+	})
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		r = r.Clone(r.Context())
+		r.Header.Set("X-Second", r.Header.Get("X-First")+"2")
+		return r, nil
+	})
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if r.URL.Path == "/short" {
+			return r, frogproxy.NewResponse(r, frogproxy.ContentTypeText, http.StatusTeapot, "short")
+		}
+		return r, nil
+	})
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if r.URL.Path == "/short" {
+			t.Error("handler after a response was run")
+		}
+		return r, nil
+	})
+	c := proxyClient(t, p)
+
+	if _, body := get(t, c, up.URL); body != "1,12" {
+		t.Fatalf("handlers did not chain: %q", body)
+	}
+	resp, body := get(t, c, up.URL+"/short")
+	if resp.StatusCode != http.StatusTeapot || body != "short" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestConflictingContentLengthIsBadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde")
+	}()
+
+	c := proxyClient(t, frogproxy.NewProxyHttpServer())
+	if resp, _ := get(t, c, "http://"+ln.Addr().String()+"/"); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestAmbiguousFramingFromHandlers(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Header.Get("Content-Length")+"|"+string(b))
+	}))
+	defer up.Close()
+
+	for _, reject := range []bool{false, true} {
+		p := frogproxy.NewProxyHttpServer()
+		p.RejectAmbiguousFraming = reject
+		p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if r.URL.Path == "/req" {
+				r.Body = io.NopCloser(strings.NewReader("body"))
+				r.ContentLength = -1
+				r.TransferEncoding = []string{"chunked"}
+				r.Header.Set("Content-Length", "4")
+			}
+			return r, nil
+		})
+		p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+			if ctx.Req.URL.Path == "/resp" {
+				resp.TransferEncoding = []string{"chunked"}
+				resp.Header.Set("Content-Length", "1")
+			}
+			return resp
+		})
+		c := proxyClient(t, p)
+
+		resp, body := get(t, c, up.URL+"/req")
+		if reject && resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("reject: request got %d, want 400", resp.StatusCode)
+		}
+		if !reject && (resp.StatusCode != http.StatusOK || body != "|body") {
+			t.Errorf("strip: request got %d %q, want Content-Length dropped", resp.StatusCode, body)
+		}
+
+		resp, body = get(t, c, up.URL+"/resp")
+		if reject && resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("reject: response got %d, want 502", resp.StatusCode)
+		}
+		if !reject && (resp.StatusCode != http.StatusOK || body != "|") {
+			t.Errorf("strip: response got %d %q", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestDisableConnReuse(t *testing.T) {
+	tests := []struct {
+		name       string
+		mitm, keep bool
+	}{
+		{"plain", false, false},
+		{"KeepHeader", false, true},
+		{"MITM", true, false},
+	}
+	for _, tt := range tests {
+		for _, disable := range []bool{false, true} {
+			var mu sync.Mutex
+			conns := map[string]bool{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				conns[r.RemoteAddr] = true
+				mu.Unlock()
+				io.WriteString(w, "hello world")
+			})
+			p := frogproxy.NewProxyHttpServer()
+			p.KeepHeader = tt.keep
+			p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+				ctx.DisableConnReuse = disable
+				return r, nil
+			})
+			var up *httptest.Server
+			var c *http.Client
+			if tt.mitm {
+				up = httptest.NewTLSServer(handler)
+				c, _ = mitmClient(t, p)
+			} else {
+				up = httptest.NewServer(handler)
+				c = proxyClient(t, p)
+			}
+			for i := 0; i < 3; i++ {
+				get(t, c, up.URL)
+			}
+			up.Close()
+			if want := map[bool]int{false: 1, true: 3}[disable]; len(conns) != want {
+				t.Errorf("%s, DisableConnReuse=%v: %d upstream connections, want %d", tt.name, disable, len(conns), want)
+			}
+		}
+	}
+}
+
+func TestRoundTripTimeout(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Header().Set("Content-Length", "10")
+			io.WriteString(w, "hello")
+			w.(http.Flusher).Flush()
+		}
+		<-release
+	}))
+	defer up.Close()
+	defer close(release)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.RoundTripTimeout = 50 * time.Millisecond
+	c := proxyClient(t, p)
+
+	resp, _ := get(t, c, up.URL+"/slow-headers")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("slow headers: got %d, want 504", resp.StatusCode)
+	}
+
+	// The timeout also covers the body: the response is cut off rather
+	// than delivered in full.
+	resp, err := c.Get(up.URL + "/slow-body")
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	if err == nil {
+		t.Fatal("slow body was delivered despite RoundTripTimeout")
+	}
+}
+
+func TestClientDisconnectAbortsUpstream(t *testing.T) {
+	aborted := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(aborted)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if _, err := io.WriteString(w, "data: tick\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer up.Close()
+	c := proxyClient(t, frogproxy.NewProxyHttpServer())
+
+	resp, err := c.Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events reach the client while the origin is still streaming.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: tick\n" {
+		t.Fatalf("first event: %q, %v", line, err)
+	}
+	resp.Body.Close()
+	c.Transport.(*http.Transport).CloseIdleConnections()
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream kept streaming after the client went away")
+	}
+}
+
+func TestMaxForwards(t *testing.T) {
+	var hits int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		io.WriteString(w, r.Method+" "+r.Header.Get("Max-Forwards"))
+	}))
+	defer up.Close()
+	c := proxyClient(t, frogproxy.NewProxyHttpServer())
+
+	do := func(method, maxForwards string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, up.URL+"/path", nil)
+		req.Header.Set("Max-Forwards", maxForwards)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	if _, body := do(http.MethodOptions, "3"); body != "OPTIONS 2" {
+		t.Fatalf("OPTIONS 3: upstream saw %q, want Max-Forwards decremented", body)
+	}
+	if _, body := do(http.MethodGet, "0"); body != "GET 0" {
+		t.Fatalf("GET 0: upstream saw %q, want it forwarded untouched", body)
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	resp, _ := do(http.MethodOptions, "0")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Allow") == "" {
+		t.Fatalf("OPTIONS 0: got %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	resp, body := do(http.MethodTrace, "0")
+	if resp.Header.Get("Content-Type") != "message/http" || !strings.HasPrefix(body, "TRACE "+up.URL+"/path HTTP/1.1") {
+		t.Fatalf("TRACE 0: got %s %q", resp.Header.Get("Content-Type"), body)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("Max-Forwards 0 reached upstream %d times", n)
+	}
+}
+
+func TestResponseHandlersSeeRoundTripError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	for _, scheme := range []string{"http", "https"} {
+		var calls int32
+		p := frogproxy.NewProxyHttpServer()
+		p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+			atomic.AddInt32(&calls, 1)
+			if resp != nil || ctx.Error == nil || ctx.Req == nil {
+				t.Errorf("%s: handler got resp=%v Error=%v Req=%v", scheme, resp, ctx.Error, ctx.Req)
+			}
+			return resp
+		})
+		var c *http.Client
+		if scheme == "https" {
+			c, _ = mitmClient(t, p)
+		} else {
+			c = proxyClient(t, p)
+		}
+		resp, _ := get(t, c, scheme+"://"+dead+"/")
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("%s: got %d, want 502", scheme, resp.StatusCode)
+		}
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Fatalf("%s: response handler ran %d times, want 1", scheme, n)
+		}
+	}
+}
+
+func TestPlainHTTPRoundTrip(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" || r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy headers reached upstream: %v", r.Header)
+		}
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Write(b)
+	}))
+	defer up.Close()
+
+	c := proxyClient(t, frogproxy.NewProxyHttpServer())
+
+	payload := strings.Repeat("round trip ", 10000)
+	req, _ := http.NewRequest("POST", up.URL+"/echo", strings.NewReader(payload))
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Method") != "POST" {
+		t.Fatalf("got %s, X-Method %q", resp.Status, resp.Header.Get("X-Method"))
+	}
+	if string(b) != payload {
+		t.Errorf("body did not round-trip: got %d bytes, want %d", len(b), len(payload))
+	}
+
+	resp, body := get(t, c, up.URL+"/empty")
+	if resp.StatusCode != http.StatusOK || body != "" {
+		t.Errorf("GET: %s %q", resp.Status, body)
+	}
+}
+
+func TestPlainHTTPUpstreamDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	resp, _ := get(t, proxyClient(t, frogproxy.NewProxyHttpServer()), "http://"+addr+"/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("unreachable upstream: got %s, want 502", resp.Status)
+	}
+}
+
+func TestDeriveIsolatesHandlers(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Chain"))
+	}))
+	defer up.Close()
+
+	parent := frogproxy.NewProxyHttpServer()
+	parent.KeepHeader = true
+	derived := parent.Derive()
+	chain := func(p *frogproxy.ProxyHttpServer, name string) {
+		p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+			r.Header.Add("X-Chain", name)
+			return r, nil
+		})
+		p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+			resp.Header.Add("X-Resp-Chain", name)
+			return resp
+		})
+	}
+	chain(parent, "parent")
+	chain(derived, "derived")
+
+	for name, p := range map[string]*frogproxy.ProxyHttpServer{"parent": parent, "derived": derived} {
+		resp, body := get(t, proxyClient(t, p), up.URL)
+		if body != name {
+			t.Errorf("%s: request handlers %q ran", name, body)
+		}
+		if got := resp.Header.Values("X-Resp-Chain"); len(got) != 1 || got[0] != name {
+			t.Errorf("%s: response handlers %q ran", name, got)
+		}
+	}
+	if !derived.KeepHeader || derived.Tr != parent.Tr {
+		t.Error("derived proxy did not keep the parent's settings and transport")
+	}
+}
+
+func TestDeriveSharesLifecycle(t *testing.T) {
+	parent := frogproxy.NewProxyHttpServer()
+	derived := parent.Derive()
+	ps := httptest.NewServer(derived)
+	defer ps.Close()
+
+	parent.Pause()
+	if _, resp := connectThrough(t, ps.URL, echoServer(t)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("derived proxy while parent paused: %s", resp.Status)
+	}
+	parent.Resume()
+
+	conn, resp := connectThrough(t, ps.URL, echoServer(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	parent.Shutdown(ctx)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("derived tunnel after parent Shutdown: read error %v, want EOF", err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up")
+	}))
+	defer up.Close()
+	target := echoServer(t)
+
+	p := frogproxy.NewProxyHttpServer()
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	c := proxyClient(t, p)
+	socksAddr := socksServer(t, p)
+
+	// A tunnel opened before pausing keeps working.
+	tunnel, resp := connectThrough(t, ps.URL, target)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, paused := range []bool{true, false, true, false} {
+		if paused {
+			p.Pause()
+		} else {
+			p.Resume()
+		}
+
+		resp, body := get(t, c, up.URL)
+		if paused && (resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "") {
+			t.Errorf("paused GET: %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+		}
+		if !paused && body != "up" {
+			t.Errorf("resumed GET: %s %q", resp.Status, body)
+		}
+
+		want := http.StatusOK
+		if paused {
+			want = http.StatusServiceUnavailable
+		}
+		_, resp = connectThrough(t, ps.URL, target)
+		if resp.StatusCode != want {
+			t.Errorf("paused=%v CONNECT: got %d, want %d", paused, resp.StatusCode, want)
+		}
+
+		socks, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := socks.Dial("tcp", target)
+		if err == nil {
+			conn.Close()
+		}
+		if (err != nil) != paused {
+			t.Errorf("paused=%v SOCKS5 dial: %v", paused, err)
+		}
+
+		io.WriteString(tunnel, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("paused=%v: established tunnel got %q, %v", paused, buf, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package frogproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AddQueryParam appends key=value to the request's query. Existing values
+// for key are kept, and the rest of the query is left as the client encoded
+// it.
+func AddQueryParam(key, value string) ReqHandler {
+	pair := url.QueryEscape(key) + "=" + url.QueryEscape(value)
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = pair
+		} else {
+			req.URL.RawQuery += "&" + pair
+		}
+		return req, nil
+	})
+}
+
+// RemoveQueryParam drops every value of key from the request's query.
+func RemoveQueryParam(key string) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.RawQuery == "" {
+			return req, nil
+		}
+		parts := strings.Split(req.URL.RawQuery, "&")
+		kept := parts[:0]
+		for _, part := range parts {
+			name, _, _ := strings.Cut(part, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == key {
+				continue
+			}
+			kept = append(kept, part)
+		}
+		req.URL.RawQuery = strings.Join(kept, "&")
+		return req, nil
+	})
+}
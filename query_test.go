@@ -0,0 +1,45 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func pathIs(path string) frogproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *frogproxy.ProxyCtx) bool {
+		return req.URL.Path == path
+	}
+}
+
+func TestQueryParamHandlers(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RawQuery)
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest(pathIs("/add")).Do(frogproxy.AddQueryParam("api key", "s&cret"))
+	p.OnRequest(pathIs("/remove")).Do(frogproxy.RemoveQueryParam("token"))
+	c := proxyClient(t, p)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"/add", "api+key=s%26cret"},
+		// Existing values, including one for the same key, are kept as sent.
+		{"/add?api+key=old&b=%2F", "api+key=old&b=%2F&api+key=s%26cret"},
+		{"/remove?token=1&a=2&tok%65n=3", "a=2"},
+		{"/remove?a=1", "a=1"},
+		{"/remove?token=1", ""},
+	}
+	for _, tt := range tests {
+		if _, got := get(t, c, up.URL+tt.query); got != tt.want {
+			t.Errorf("%s: upstream saw %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package frogproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+)
+
+type replayBuffer struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+func newReplayBuffer(r io.Reader, memLimit int64) (*replayBuffer, error) {
+	mem, err := io.ReadAll(io.LimitReader(r, memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(mem)) <= memLimit {
+		return &replayBuffer{mem: mem, size: int64(len(mem))}, nil
+	}
+	f, err := os.CreateTemp("", "frogproxy-body-")
+	if err != nil {
+		return nil, err
+	}
+	b := &replayBuffer{file: f}
+	if b.size, err = io.Copy(f, io.MultiReader(bytes.NewReader(mem), r)); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *replayBuffer) reader() (io.ReadCloser, error) {
+	if b.file != nil {
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size)), nil
+	}
+	return io.NopCloser(bytes.NewReader(b.mem)), nil
+}
+
+func (b *replayBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// ReplayableRequestBody reads the request body up front so it can be sent
+// again, e.g. by RetryOn5xx. Bodies larger than memLimit are spilled to a
+// temporary file that is removed once the request completes.
+func ReplayableRequestBody(memLimit int64) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+			return req, nil
+		}
+		buf, err := newReplayBuffer(req.Body, memLimit)
+		req.Body.Close()
+		if err != nil {
+			ctx.Warnf("Cannot buffer request body for replay: %v", err)
+			return req, NewResponse(req, ContentTypeText, http.StatusBadRequest, "cannot read request body")
+		}
+		ctx.onDone(func() { buf.Close() })
+		req.Body, _ = buf.reader()
+		req.GetBody = buf.reader
+		req.ContentLength = buf.size
+		req.TransferEncoding = nil
+		return req, nil
+	})
+}
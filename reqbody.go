@@ -0,0 +1,55 @@
+package frogproxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DefaultMaxRequestBodyBuffer caps ctx.ReqBody when BufferRequestBodies is
+// set and MaxRequestBodyBuffer is not positive.
+var DefaultMaxRequestBodyBuffer int64 = 1 << 20
+
+type requestBodyRecorder struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	buf []byte
+	max int64
+}
+
+func (proxy *ProxyHttpServer) recordRequestBody(req *http.Request) *requestBodyRecorder {
+	if !proxy.BufferRequestBodies || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	max := proxy.MaxRequestBodyBuffer
+	if max <= 0 {
+		max = DefaultMaxRequestBodyBuffer
+	}
+	rec := &requestBodyRecorder{ReadCloser: req.Body, max: max}
+	req.Body = rec
+	return rec
+}
+
+func (r *requestBodyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.mu.Lock()
+		if room := r.max - int64(len(r.buf)); room > 0 {
+			if int64(n) < room {
+				room = int64(n)
+			}
+			r.buf = append(r.buf, p[:room]...)
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *requestBodyRecorder) bytes() []byte {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.buf...)
+}
@@ -0,0 +1,63 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestBufferRequestBodies(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	})
+	plainUp := httptest.NewServer(echo)
+	defer plainUp.Close()
+	tlsUp := httptest.NewTLSServer(echo)
+	defer tlsUp.Close()
+
+	body := strings.Repeat("0123456789", 10)
+	for _, tt := range []struct {
+		name   string
+		buffer bool
+		max    int64
+		want   string
+	}{
+		{"disabled", false, 0, ""},
+		{"whole body", true, 0, body},
+		{"capped", true, 25, body[:25]},
+	} {
+		for _, mitm := range []bool{false, true} {
+			p := frogproxy.NewProxyHttpServer()
+			p.BufferRequestBodies = tt.buffer
+			p.MaxRequestBodyBuffer = tt.max
+			seen := make(chan []byte, 1)
+			p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+				seen <- ctx.ReqBody
+				return resp
+			})
+			c, target := proxyClient(t, p), plainUp.URL
+			if mitm {
+				c, _ = mitmClient(t, p)
+				target = tlsUp.URL
+			}
+
+			resp, err := c.Post(target, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			echoed, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(echoed) != body {
+				t.Errorf("%s, mitm=%v: origin got %d bytes, want %d", tt.name, mitm, len(echoed), len(body))
+			}
+			if got := string(<-seen); got != tt.want {
+				t.Errorf("%s, mitm=%v: ctx.ReqBody = %q, want %q", tt.name, mitm, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package frogproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxRequestLineLength caps the request line of MITM'd requests, in
+// bytes excluding the line ending, when MaxRequestLineLength is not
+// positive. Longer lines are answered with 414 URI Too Long.
+var DefaultMaxRequestLineLength = 8192
+
+func (proxy *ProxyHttpServer) maxRequestLineLength() int {
+	if proxy.MaxRequestLineLength > 0 {
+		return proxy.MaxRequestLineLength
+	}
+	return DefaultMaxRequestLineLength
+}
+
+// requestLineTooLong peeks at the next request line without consuming it.
+// r must be able to buffer at least max+2 bytes.
+func requestLineTooLong(r *bufio.Reader, max int) bool {
+	for n := 1; ; n = r.Buffered() + 1 {
+		_, err := r.Peek(n)
+		b, _ := r.Peek(r.Buffered())
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return len(bytes.TrimRight(b[:i], "\r")) > max
+		}
+		if len(b) > max {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func writeURITooLong(w io.Writer) error {
+	const body = "Request line too long"
+	resp := &http.Response{
+		StatusCode:    http.StatusRequestURITooLong,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {ContentTypeText}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(w)
+}
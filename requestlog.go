@@ -0,0 +1,75 @@
+package frogproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestLogBody counts the bytes read from a response body. The count is
+// atomic because an upgraded connection is read and closed from different
+// goroutines.
+type requestLogBody struct {
+	io.ReadCloser
+	n    atomic.Int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *requestLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (b *requestLogBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n.Load()) })
+	return err
+}
+
+// LogRequests registers handlers that write one line per request to w:
+// session, method, url, status, body bytes sent and duration, plus the
+// error when the round trip failed. The line is written once the client
+// has been sent the whole body. Register it first so its timing covers
+// the other handlers; it leaves ctx.UserData alone.
+func (proxy *ProxyHttpServer) LogRequests(w io.Writer) {
+	var mu sync.Mutex
+	logLine := func(ctx *ProxyCtx, status int, n int64) {
+		url := "-"
+		method := "-"
+		if ctx.Req != nil {
+			method = ctx.Req.Method
+			if ctx.Req.URL != nil {
+				url = ctx.Req.URL.String()
+			}
+		}
+		line := fmt.Sprintf("session=%d method=%s url=%s status=%d bytes=%d duration=%s",
+			ctx.Session, method, url, status, n, time.Since(ctx.started))
+		if ctx.Error != nil {
+			line += fmt.Sprintf(" error=%q", ctx.Error.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, line+"\n")
+	}
+
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.started = time.Now()
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if ctx.started.IsZero() {
+			ctx.started = time.Now()
+		}
+		if resp == nil || resp.Body == nil {
+			logLine(ctx, 0, 0)
+			return resp
+		}
+		ctx.PassThroughBody(resp, &requestLogBody{ReadCloser: resp.Body, done: func(n int64) { logLine(ctx, resp.StatusCode, n) }})
+		return resp
+	})
+}
@@ -0,0 +1,83 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestLogRequests(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello world")
+	}))
+	defer up.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	lineRe := regexp.MustCompile(`^session=\d+ method=(\S+) url=(\S+) status=(\d+) bytes=(\d+) duration=\S+( error=".+")?$`)
+	for _, tt := range []struct {
+		name   string
+		method string
+		url    string
+		status string
+		bytes  string
+		failed bool
+	}{
+		{"ok", "GET", up.URL + "/ok", "200", "11", false},
+		{"not found", "GET", up.URL + "/missing", "404", "19", false},
+		{"head", "HEAD", up.URL + "/ok", "200", "0", false},
+		{"upstream down", "GET", deadURL, "0", "0", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &logBuffer{}
+			p := frogproxy.NewProxyHttpServer()
+			p.LogRequests(logs)
+			var userData interface{}
+			p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+				ctx.UserData = "mine"
+				return r, nil
+			})
+			p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+				userData = ctx.UserData
+				return resp
+			})
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			resp, err := proxyClient(t, p).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			eventually(t, func() bool { return logs.String() != "" }, "no request logged")
+			lines := strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("logged %q, want one line", lines)
+			}
+			m := lineRe.FindStringSubmatch(lines[0])
+			if m == nil {
+				t.Fatalf("malformed log line %q", lines[0])
+			}
+			if m[1] != tt.method || m[2] != tt.url || m[3] != tt.status || m[4] != tt.bytes || (m[5] != "") != tt.failed {
+				t.Errorf("logged %q, want %s %s status=%s bytes=%s failed=%v", lines[0], tt.method, tt.url, tt.status, tt.bytes, tt.failed)
+			}
+			if userData != "mine" {
+				t.Errorf("ctx.UserData = %v, want it left to the user", userData)
+			}
+		})
+	}
+}
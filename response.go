@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"net/http"
+	"strconv"
 )
 
 func NewResponse(r *http.Request, contentType string, status int, body string) *http.Response {
@@ -20,6 +21,20 @@ func NewResponse(r *http.Request, contentType string, status int, body string) *
 	return resp
 }
 
+func NewEmptyResponse(r *http.Request, status int) *http.Response {
+	return &http.Response{
+		Request:       r,
+		Header:        make(http.Header),
+		StatusCode:    status,
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		ContentLength: 0,
+		Body:          http.NoBody,
+	}
+}
+
 const (
 	ContentTypeText = "text/plain"
 )
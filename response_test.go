@@ -0,0 +1,86 @@
+package frogproxy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestNewEmptyResponse(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		status := http.StatusNoContent
+		switch r.URL.Path {
+		case "/not-modified":
+			status = http.StatusNotModified
+		case "/ok":
+			status = http.StatusOK
+		}
+		return r, frogproxy.NewEmptyResponse(r, status)
+	})
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyAddr := strings.TrimPrefix(ps.URL, "http://")
+
+	// exchange sends one request with Connection: close and returns the
+	// raw response, so any stray body bytes are visible.
+	exchange := func(conn net.Conn, target string) string {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: tracker.test\r\nConnection: close\r\n\r\n")
+		raw, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+	plain := func(path string) string {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return exchange(conn, "http://tracker.test"+path)
+	}
+	mitm := func(path string) string {
+		conn, resp := connectThrough(t, ps.URL, "tracker.test:443")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %s", resp.Status)
+		}
+		return exchange(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), path)
+	}
+
+	tests := []struct {
+		path, status string
+		length       bool
+	}{
+		{"/pixel", "204 No Content", false},
+		{"/not-modified", "304 Not Modified", false},
+		{"/ok", "200 OK", true},
+	}
+	for name, send := range map[string]func(string) string{"plain": plain, "mitm": mitm} {
+		for _, tt := range tests {
+			raw := send(tt.path)
+			head, body, _ := strings.Cut(raw, "\r\n\r\n")
+			if !strings.HasPrefix(head, "HTTP/1.1 "+tt.status) {
+				t.Errorf("%s %s: status line %q", name, tt.path, strings.SplitN(head, "\r\n", 2)[0])
+			}
+			if body != "" {
+				t.Errorf("%s %s: body %q sent", name, tt.path, body)
+			}
+			if strings.Contains(head, "Transfer-Encoding") {
+				t.Errorf("%s %s: chunked framing for an empty response:\n%s", name, tt.path, head)
+			}
+			if hasLength := strings.Contains(head, "Content-Length: 0"); hasLength != tt.length {
+				t.Errorf("%s %s: Content-Length: 0 present = %v, want %v:\n%s", name, tt.path, hasLength, tt.length, head)
+			}
+		}
+	}
+}
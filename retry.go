@@ -0,0 +1,63 @@
+package frogproxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// RetryOn5xx re-sends a request whose response has one of statuses, or any
+// 5xx status when none are given, to alt and returns alt's response instead.
+// The request re-sent is the one that got the response, as left by the
+// request handlers. A request with a body is only retried when its GetBody
+// is set, e.g. by ReplayableRequestBody; otherwise the response is kept.
+func RetryOn5xx(alt *url.URL, statuses ...int) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || !retryableStatus(resp.StatusCode, statuses) {
+			return resp
+		}
+		sent := resp.Request
+		if sent == nil {
+			sent = ctx.Req
+		}
+		if sent == nil {
+			return resp
+		}
+		req := sent.Clone(sent.Context())
+		req.URL.Scheme = alt.Scheme
+		req.URL.Host = alt.Host
+		req.Host = ""
+		req.RequestURI = ""
+		if sent.Body != nil && sent.Body != http.NoBody && sent.ContentLength != 0 {
+			if sent.GetBody == nil {
+				ctx.Warnf("Cannot retry %v on %v: request body is not replayable", sent.URL, alt.Host)
+				return resp
+			}
+			body, err := sent.GetBody()
+			if err != nil {
+				ctx.Warnf("Cannot replay request body for retry: %v", err)
+				return resp
+			}
+			req.Body = body
+		}
+		ctx.Logf("Upstream returned %d, retrying on %v", resp.StatusCode, alt.Host)
+		altResp, err := ctx.RoundTrip(req)
+		if err != nil {
+			ctx.Warnf("Retry on %v failed: %v", alt.Host, err)
+			return resp
+		}
+		resp.Body.Close()
+		return altResp
+	})
+}
+
+func retryableStatus(code int, statuses []int) bool {
+	if len(statuses) == 0 {
+		return code >= 500 && code < 600
+	}
+	for _, s := range statuses {
+		if code == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// unavailableOnce answers 503 to its first request and then echoes the
+// X-Handled header and the request body.
+func unavailableOnce(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if hits.Add(1) == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, r.Header.Get("X-Handled")+":"+string(b))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestRetryOn5xx(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		replay   bool
+		statuses []int
+		status   int
+		body     string
+		hits     int32
+	}{
+		{"retries the handled request", true, nil, http.StatusOK, "yes:payload", 2},
+		{"retries listed status", true, []int{503}, http.StatusOK, "yes:payload", 2},
+		{"ignores unlisted status", true, []int{502}, http.StatusServiceUnavailable, "try later\n", 1},
+		{"keeps response for unreplayable body", false, nil, http.StatusServiceUnavailable, "try later\n", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up, hits := unavailableOnce(t)
+			alt, _ := url.Parse(up.URL)
+
+			p := frogproxy.NewProxyHttpServer()
+			if tc.replay {
+				p.OnRequest().Do(frogproxy.ReplayableRequestBody(1 << 20))
+			}
+			p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+				r = r.Clone(r.Context())
+				r.Header.Set("X-Handled", "yes")
+				return r, nil
+			})
+			p.OnResponse().Do(frogproxy.RetryOn5xx(alt, tc.statuses...))
+
+			resp, err := proxyClient(t, p).Post(up.URL, "text/plain", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status || string(b) != tc.body {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, b, tc.status, tc.body)
+			}
+			if got := hits.Load(); got != tc.hits {
+				t.Errorf("upstream hit %d times, want %d", got, tc.hits)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package frogproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connTracker tracks hijacked client connections and their upstreams so
+// Shutdown can wait for them. Connections marked idle, such as a MITM'd
+// client between requests, are closed as soon as draining starts.
+type connTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	conns    map[net.Conn]bool
+	draining bool
+}
+
+func (t *connTracker) track(conns ...net.Conn) (untrack func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]bool)
+	}
+	for _, c := range conns {
+		t.conns[c] = false
+	}
+	t.wg.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			for _, c := range conns {
+				delete(t.conns, c)
+			}
+			t.mu.Unlock()
+			t.wg.Done()
+		})
+	}, true
+}
+
+// setIdle marks a tracked connection as waiting for its next request, or
+// busy again. An idle connection is closed if the tracker is draining.
+func (t *connTracker) setIdle(c net.Conn, idle bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[c]; !ok {
+		return
+	}
+	t.conns[c] = idle
+	if idle && t.draining {
+		c.Close()
+	}
+}
+
+// drain refuses new connections and closes the idle ones.
+func (t *connTracker) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	for c, idle := range t.conns {
+		if idle {
+			c.Close()
+		}
+	}
+}
+
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	for c := range t.conns {
+		c.Close()
+	}
+}
+
+func (t *connTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (proxy *ProxyHttpServer) ListenAndServe(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: proxy}
+	st := proxy.state
+	st.serverMu.Lock()
+	if st.shutdown {
+		st.serverMu.Unlock()
+		return http.ErrServerClosed
+	}
+	if st.servers == nil {
+		st.servers = make(map[*http.Server]struct{})
+	}
+	st.servers[srv] = struct{}{}
+	st.serverMu.Unlock()
+	return srv.ListenAndServe()
+}
+
+// trackListener registers l so Shutdown closes it. It reports false once
+// the proxy is shutting down.
+func (proxy *ProxyHttpServer) trackListener(l net.Listener) bool {
+	st := proxy.state
+	st.serverMu.Lock()
+	defer st.serverMu.Unlock()
+	if st.shutdown {
+		return false
+	}
+	if st.listeners == nil {
+		st.listeners = make(map[net.Listener]struct{})
+	}
+	st.listeners[l] = struct{}{}
+	return true
+}
+
+func (proxy *ProxyHttpServer) untrackListener(l net.Listener) {
+	proxy.state.serverMu.Lock()
+	delete(proxy.state.listeners, l)
+	proxy.state.serverMu.Unlock()
+}
+
+func (proxy *ProxyHttpServer) isShutdown() bool {
+	proxy.state.serverMu.Lock()
+	defer proxy.state.serverMu.Unlock()
+	return proxy.state.shutdown
+}
+
+// Shutdown stops the proxy and every proxy derived from it. It closes their
+// listeners and refuses new connections, then waits for in-flight requests,
+// CONNECT tunnels, MITM'd and locally served connections to finish. MITM'd
+// and local connections are closed as soon as they are idle. When ctx is
+// done first, everything still open is closed and ctx's error is returned.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	st := proxy.state
+	st.serverMu.Lock()
+	st.shutdown = true
+	var servers []*http.Server
+	for srv := range st.servers {
+		servers = append(servers, srv)
+	}
+	for l := range st.listeners {
+		l.Close()
+	}
+	st.serverMu.Unlock()
+
+	st.tracker.drain()
+	var err error
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); err == nil {
+			err = serr
+		}
+	}
+	if werr := st.tracker.wait(ctx); werr != nil {
+		st.tracker.closeAll()
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
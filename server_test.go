@@ -0,0 +1,194 @@
+package frogproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func waitErr(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("server still running after Shutdown")
+	}
+	return nil
+}
+
+func TestShutdownBeforeListenAndServe(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		p := frogproxy.NewProxyHttpServer()
+		served := make(chan error, 1)
+		shut := make(chan struct{})
+		go func() {
+			p.Shutdown(context.Background())
+			close(shut)
+		}()
+		go func() { served <- p.ListenAndServe("127.0.0.1:0") }()
+		<-shut
+		// ListenAndServe may have started first; Shutdown must stop it
+		// either way.
+		if err := waitErr(t, served); !errors.Is(err, http.ErrServerClosed) {
+			t.Fatalf("ListenAndServe: %v", err)
+		}
+	}
+}
+
+func TestShutdownClosesSOCKS5Listeners(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.ServeSOCKS5(ln) }()
+
+	// Wait until the listener is being served.
+	for {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, served); !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("ServeSOCKS5: %v", err)
+	}
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("SOCKS5 listener still accepting after Shutdown")
+	}
+
+	ln2, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln2.Close()
+	if err := p.ServeSOCKS5(ln2); !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("ServeSOCKS5 after Shutdown: %v", err)
+	}
+}
+
+func TestShutdownDrainsDerivedTunnels(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	ps := httptest.NewServer(p.Derive())
+	defer ps.Close()
+	conn, resp := connectThrough(t, ps.URL, echoServer(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- p.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with a tunnel open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(conn, "still here")
+	buf := make([]byte, len("still here"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("tunnel cut off while draining: %v", err)
+	}
+	conn.Close()
+	if err := waitErr(t, done); err != nil {
+		t.Fatalf("Shutdown after the tunnel closed: %v", err)
+	}
+}
+
+func TestShutdownClosesTunnelsAtDeadline(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	conn, _ := connectThrough(t, ps.URL, echoServer(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: got %v, want DeadlineExceeded", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("tunnel after the deadline: read error %v, want EOF", err)
+	}
+}
+
+func TestShutdownClosesIdleMitmConns(t *testing.T) {
+	p := frogproxy.NewProxyHttpServer()
+	c, up := mitmClient(t, p)
+	if _, body := get(t, c, up.URL); body != "hello world" {
+		t.Fatalf("got %q", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown waited %v for an idle MITM connection", d)
+	}
+}
+
+func TestShutdownWaitsForLocalTLSRequest(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.FuncHttpsHandler(func(host string, ctx *frogproxy.ProxyCtx) (*frogproxy.ConnectAction, string) {
+		return frogproxy.ServeLocalTLS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+			io.WriteString(w, "local")
+		}), nil), host
+	}))
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: tr}).Get("https://local.test/")
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		got <- string(b)
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- p.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned during a local request: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if body := <-got; body != "local" {
+		t.Fatalf("local request: %s", body)
+	}
+	if err := waitErr(t, done); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
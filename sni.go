@@ -0,0 +1,57 @@
+package frogproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// TunnelRouterPeekTimeout bounds how long a tunnel waits for the client to
+// send its TLS ClientHello before TunnelRouter is consulted. When it
+// expires, as it does for protocols where the server speaks first, the
+// router sees an empty SNI and the tunnel usually takes its default route.
+var TunnelRouterPeekTimeout = 2 * time.Second
+
+// tlsInternalErrorAlert is a plaintext fatal internal_error alert. A routed
+// tunnel whose upstream cannot be dialed answers the ClientHello with it,
+// since the client already has its 200 and would read a 502 as TLS.
+var tlsInternalErrorAlert = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x50}
+
+// isClientHello reports whether b starts with a TLS handshake record.
+func isClientHello(b []byte) bool {
+	return len(b) > 0 && b[0] == 0x16
+}
+
+// peekClientHello reads the client's ClientHello, returning its SNI along
+// with every byte read so they can be replayed upstream.
+func peekClientHello(conn net.Conn, timeout time.Duration) (sni string, hello []byte) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var buf bytes.Buffer
+	tlsConn := tls.Server(readOnlyConn{io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = info.ServerName
+			return nil, errClientHelloPeeked
+		},
+	})
+	tlsConn.Handshake()
+	return sni, buf.Bytes()
+}
@@ -0,0 +1,251 @@
+package frogproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5NoAcceptable   = 0xff
+	socks5CmdConnect     = 0x01
+	socks5AtypIPv4       = 0x01
+	socks5AtypDomain     = 0x03
+	socks5AtypIPv6       = 0x04
+	socks5Succeeded      = 0x00
+	socks5Failure        = 0x01
+	socks5NotAllowed     = 0x02
+	socks5CmdNotSupport  = 0x07
+	socks5AtypNotSupport = 0x08
+)
+
+func (proxy *ProxyHttpServer) ServeSOCKS5(l net.Listener) error {
+	if !proxy.trackListener(l) {
+		return http.ErrServerClosed
+	}
+	defer proxy.untrackListener(l)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if proxy.isShutdown() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go proxy.serveSOCKS5Conn(c)
+	}
+}
+
+func (proxy *ProxyHttpServer) serveSOCKS5Conn(c net.Conn) {
+	addr, err := proxy.socks5Handshake(c)
+	if err != nil {
+		proxy.Logger.Printf("SOCKS5 handshake with %v failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if proxy.state.paused.Load() {
+		writeSocks5Reply(c, socks5Failure)
+		c.Close()
+		return
+	}
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	proxy.handleConnect(r, newSocksReplyConn(c))
+}
+
+func (proxy *ProxyHttpServer) socks5Handshake(c net.Conn) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(head[0])))
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if proxy.SOCKS5Auth != nil {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthPassword {
+		if err := proxy.socks5Authenticate(c); err != nil {
+			return "", err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return "", err
+	}
+	if req[1] != socks5CmdConnect {
+		writeSocks5Reply(c, socks5CmdNotSupport)
+		return "", errors.New("unsupported SOCKS command " + strconv.Itoa(int(req[1])))
+	}
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return "", err
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(c, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(c, socks5AtypNotSupport)
+		return "", errors.New("unsupported SOCKS address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (proxy *ProxyHttpServer) socks5Authenticate(c net.Conn) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	user := make([]byte, head[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(c, plen); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return err
+	}
+	if !proxy.SOCKS5Auth(string(user), string(pass)) {
+		c.Write([]byte{0x01, 0x01})
+		return errors.New("invalid SOCKS credentials for user " + string(user))
+	}
+	_, err := c.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func writeSocks5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+const (
+	socksAwaitStatus = iota
+	socksSkipHeaders
+	socksPassThrough
+	socksDiscard
+)
+
+type socksReplyConn struct {
+	net.Conn
+	state int
+	tail  []byte
+}
+
+type socksReplyHalfConn struct {
+	*socksReplyConn
+}
+
+func (c socksReplyHalfConn) CloseWrite() error {
+	return c.Conn.(halfClosable).CloseWrite()
+}
+
+func (c socksReplyHalfConn) CloseRead() error {
+	return c.Conn.(halfClosable).CloseRead()
+}
+
+func newSocksReplyConn(c net.Conn) net.Conn {
+	rc := &socksReplyConn{Conn: c}
+	if _, ok := c.(halfClosable); ok {
+		return socksReplyHalfConn{rc}
+	}
+	return rc
+}
+
+func (c *socksReplyConn) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		switch c.state {
+		case socksAwaitStatus:
+			end := bytes.Index(p, []byte("\r\n"))
+			if !bytes.HasPrefix(p, []byte("HTTP/")) || end < 0 {
+				return 0, errors.New("expected an HTTP status line for SOCKS reply")
+			}
+			rep := byte(socks5Failure)
+			if fields := bytes.Fields(p[:end]); len(fields) > 1 {
+				switch code, _ := strconv.Atoi(string(fields[1])); {
+				case code >= 200 && code < 300:
+					rep = socks5Succeeded
+				case code == http.StatusForbidden:
+					rep = socks5NotAllowed
+				}
+			}
+			if err := writeSocks5Reply(c.Conn, rep); err != nil {
+				return 0, err
+			}
+			c.state = socksSkipHeaders
+			if rep != socks5Succeeded {
+				c.state = socksDiscard
+			}
+			c.tail = []byte("\r\n")
+			p = p[end+2:]
+		case socksSkipHeaders:
+			buf := append(c.tail, p...)
+			if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+				p = p[i+4-len(c.tail):]
+				c.state = socksPassThrough
+				continue
+			}
+			if len(buf) > 3 {
+				buf = buf[len(buf)-3:]
+			}
+			c.tail = append([]byte(nil), buf...)
+			p = nil
+		case socksPassThrough:
+			n, err := c.Conn.Write(p)
+			return total - len(p) + n, err
+		case socksDiscard:
+			p = nil
+		}
+	}
+	return total, nil
+}
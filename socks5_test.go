@@ -0,0 +1,144 @@
+package frogproxy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+	"golang.org/x/net/proxy"
+)
+
+// socksServer serves p as a SOCKS5 proxy and returns its address.
+func socksServer(t *testing.T, p *frogproxy.ProxyHttpServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go p.ServeSOCKS5(ln)
+	return ln.Addr().String()
+}
+
+func TestConnectDialToSocks5Proxy(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via socks")
+	}))
+	defer up.Close()
+	tlsUp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled via socks")
+	}))
+	defer tlsUp.Close()
+
+	socks := frogproxy.NewProxyHttpServer()
+	var authed atomic.Int32
+	socks.SOCKS5Auth = func(user, password string) bool {
+		authed.Add(1)
+		return user == "frog" && password == "secret"
+	}
+	socksAddr := socksServer(t, socks)
+
+	p := frogproxy.NewProxyHttpServer()
+	p.ConnectDial = p.NewConnectDialToSocks5Proxy(socksAddr, &proxy.Auth{User: "frog", Password: "secret"})
+	c := proxyClient(t, p)
+	c.Transport.(*http.Transport).TLSClientConfig = tlsUp.Client().Transport.(*http.Transport).TLSClientConfig
+
+	if _, body := get(t, c, up.URL); body != "via socks" {
+		t.Errorf("plain HTTP: got %q", body)
+	}
+	plain := authed.Load()
+	if plain == 0 {
+		t.Error("plain HTTP request did not go through the SOCKS5 upstream")
+	}
+
+	if _, body := get(t, c, tlsUp.URL); body != "tunneled via socks" {
+		t.Errorf("CONNECT: got %q", body)
+	}
+	if authed.Load() == plain {
+		t.Error("CONNECT tunnel did not go through the SOCKS5 upstream")
+	}
+}
+
+func TestConnectDialToSocks5ProxyBadCredentials(t *testing.T) {
+	socks := frogproxy.NewProxyHttpServer()
+	socks.SOCKS5Auth = func(user, password string) bool { return false }
+	socksAddr := socksServer(t, socks)
+
+	p := frogproxy.NewProxyHttpServer()
+	dial := p.NewConnectDialToSocks5Proxy(socksAddr, &proxy.Auth{User: "frog", Password: "wrong"})
+	if c, err := dial("tcp", "127.0.0.1:1"); err == nil {
+		c.Close()
+		t.Fatal("dial succeeded with rejected credentials")
+	}
+}
+
+func TestServeSOCKS5(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.SOCKS5Auth = func(user, password string) bool { return user == "frog" && password == "secret" }
+	socksAddr := socksServer(t, p)
+
+	for _, tc := range []struct {
+		user   *url.Userinfo
+		status int
+		body   string
+	}{
+		{url.UserPassword("frog", "secret"), http.StatusOK, "hello /socks"},
+		{url.UserPassword("frog", "wrong"), 0, ""},
+	} {
+		tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: socksAddr, User: tc.user})}
+		resp, err := (&http.Client{Transport: tr}).Get(up.URL + "/socks")
+		tr.CloseIdleConnections()
+		if tc.status == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%v: request succeeded with rejected credentials", tc.user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", tc.user, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || string(b) != tc.body {
+			t.Errorf("%v: got %d %q", tc.user, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestServeSOCKS5Mitm(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer up.Close()
+
+	p := frogproxy.NewProxyHttpServer()
+	p.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	p.OnResponse().DoFunc(func(resp *http.Response, ctx *frogproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Seen-By-Proxy", "1")
+		return resp
+	})
+	socksAddr := socksServer(t, p)
+
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "socks5", Host: socksAddr}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer tr.CloseIdleConnections()
+	resp, body := get(t, &http.Client{Transport: tr}, up.URL)
+	if body != "hello" || resp.Header.Get("X-Seen-By-Proxy") != "1" {
+		t.Errorf("got %q, X-Seen-By-Proxy %q", body, resp.Header.Get("X-Seen-By-Proxy"))
+	}
+}
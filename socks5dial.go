@@ -0,0 +1,39 @@
+package frogproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
+
+// NewConnectDialToSocks5Proxy returns a ConnectDial that reaches its targets
+// through the SOCKS5 proxy at addr, authenticating with auth when it is not
+// nil. The SOCKS5 proxy itself is dialed with the proxy's own dialer. Plain
+// HTTP requests are sent through the same upstream by pointing proxy.Tr at
+// it, so assigning the result to ConnectDial covers both kinds of traffic.
+func (proxy *ProxyHttpServer) NewConnectDialToSocks5Proxy(addr string, auth *proxy.Auth) func(network, addr string) (net.Conn, error) {
+	dial, err := socks5Dialer(addr, auth, proxy.dial)
+	if err != nil {
+		return nil
+	}
+	u := &url.URL{Scheme: "socks5", Host: addr}
+	if auth != nil {
+		u.User = url.UserPassword(auth.User, auth.Password)
+	}
+	proxy.Tr.Proxy = http.ProxyURL(u)
+	return dial
+}
+
+func socks5Dialer(addr string, auth *proxy.Auth, forward func(network, addr string) (net.Conn, error)) (func(network, addr string) (net.Conn, error), error) {
+	d, err := proxy.SOCKS5("tcp", addr, auth, dialerFunc(forward))
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial, nil
+}
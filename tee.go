@@ -0,0 +1,28 @@
+package frogproxy
+
+import "io"
+
+// TeeReadCloser copies everything read from a body to w, closing both the
+// body and w when it is closed.
+type TeeReadCloser struct {
+	r io.Reader
+	w io.WriteCloser
+	c io.Closer
+}
+
+func (t *TeeReadCloser) Close() error {
+	err1 := t.c.Close()
+	err2 := t.w.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+func (t *TeeReadCloser) Read(p []byte) (int, error) {
+	return t.r.Read(p)
+}
+
+func NewTeeReadCloser(r io.ReadCloser, w io.WriteCloser) io.ReadCloser {
+	return &TeeReadCloser{io.TeeReader(r, w), w, r}
+}
@@ -0,0 +1,142 @@
+// Package testutil helps testing proxy handlers without a network.
+//
+// A fixture file is a JSON array of request/response pairs:
+//
+//	[
+//	  {
+//	    "request": {"method": "GET", "url": "http://example.com/"},
+//	    "response": {
+//	      "status": 200,
+//	      "header": {"Content-Type": ["text/html"]},
+//	      "body": "<html></html>"
+//	    }
+//	  }
+//	]
+//
+// A request matches a fixture when its method and URL are equal to the
+// fixture's, ignoring a default port, so MITM'd requests for
+// "https://example.com:443/" match "https://example.com/". If the fixture request has a body, the request body must
+// match it too. Method defaults to GET.
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fj9140/frogproxy"
+)
+
+var ErrNoFixture = errors.New("no fixture matches request")
+
+type FixtureRequest struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type FixtureResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type Fixture struct {
+	Request  FixtureRequest  `json:"request"`
+	Response FixtureResponse `json:"response"`
+}
+
+// FixtureRoundTripper answers requests from recorded fixtures. Set it as
+// ctx.RoundTripper in a request handler to keep requests off the network.
+type FixtureRoundTripper struct {
+	Fixtures []Fixture
+}
+
+func LoadFixtures(paths ...string) (*FixtureRoundTripper, error) {
+	rt := &FixtureRoundTripper{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fixtures []Fixture
+		if err := json.Unmarshal(b, &fixtures); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for i, f := range fixtures {
+			if f.Request.URL == "" {
+				return nil, fmt.Errorf("%s: fixture %d has no request url", path, i)
+			}
+		}
+		rt.Fixtures = append(rt.Fixtures, fixtures...)
+	}
+	return rt, nil
+}
+
+func (rt *FixtureRoundTripper) RoundTrip(req *http.Request, ctx *frogproxy.ProxyCtx) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	for _, f := range rt.Fixtures {
+		if f.matches(req, body) {
+			return f.Response.toResponse(req), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrNoFixture, req.Method, req.URL)
+}
+
+func (f *Fixture) matches(req *http.Request, body []byte) bool {
+	method := f.Request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != req.Method || stripDefaultPort(f.Request.URL) != stripDefaultPort(req.URL.String()) {
+		return false
+	}
+	return f.Request.Body == "" || f.Request.Body == string(body)
+}
+
+func stripDefaultPort(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if port := u.Port(); port == "443" && u.Scheme == "https" || port == "80" && u.Scheme == "http" {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	return u.String()
+}
+
+func (r *FixtureResponse) toResponse(req *http.Request) *http.Response {
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,98 @@
+package testutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func loadExample(t *testing.T) *FixtureRoundTripper {
+	t.Helper()
+	rt, err := LoadFixtures("testdata/example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestLoadFixtures(t *testing.T) {
+	if rt := loadExample(t); len(rt.Fixtures) != 3 {
+		t.Fatalf("loaded %d fixtures, want 3", len(rt.Fixtures))
+	}
+	if _, err := LoadFixtures("testdata/no-url.json"); err == nil || !strings.Contains(err.Error(), "no request url") {
+		t.Fatalf("fixture without url: got %v", err)
+	}
+	if _, err := LoadFixtures("testdata/missing.json"); err == nil {
+		t.Fatal("missing file loaded")
+	}
+}
+
+func TestFixtureRoundTripper(t *testing.T) {
+	rt := loadExample(t)
+	tests := []struct {
+		method, url, body string
+		status            int
+		want              string
+	}{
+		{"GET", "http://example.com/", "", 200, "<html>plain</html>"},
+		{"GET", "https://example.com:443/api", "", 200, `{"ok":true}`},
+		{"POST", "https://example.com/api", "ping", 201, "pong"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		resp, err := rt.RoundTrip(req, nil)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.url, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || string(b) != tt.want {
+			t.Errorf("%s %s: got %d %q", tt.method, tt.url, resp.StatusCode, b)
+		}
+	}
+
+	for _, u := range []string{"http://example.com/missing", "http://example.com:8080/"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		if _, err := rt.RoundTrip(req, nil); !errors.Is(err, ErrNoFixture) {
+			t.Errorf("%s: got %v, want ErrNoFixture", u, err)
+		}
+	}
+}
+
+func TestFixtureRoundTripperThroughProxy(t *testing.T) {
+	rt := loadExample(t)
+	p := frogproxy.NewProxyHttpServer()
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	p.OnRequest().DoFunc(func(r *http.Request, ctx *frogproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = rt
+		return r, nil
+	})
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	c := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(pu),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for u, want := range map[string]string{
+		"http://example.com/":     "<html>plain</html>",
+		"https://example.com/api": `{"ok":true}`,
+	} {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != want {
+			t.Errorf("%s: got %d %q, want %q", u, resp.StatusCode, b, want)
+		}
+	}
+}
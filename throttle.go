@@ -0,0 +1,45 @@
+package frogproxy
+
+import (
+	"io"
+	"math/rand"
+	"time"
+)
+
+// ThrottleProfile paces response bodies sent to clients, emulating a slow
+// network.
+type ThrottleProfile struct {
+	// ChunkSize caps the bytes delivered per delay; zero leaves reads
+	// their natural size.
+	ChunkSize int
+	// Latency is added before every chunk.
+	Latency time.Duration
+	// Jitter adds a random extra delay of up to Jitter to every chunk.
+	Jitter time.Duration
+}
+
+type pacingReader struct {
+	r       io.Reader
+	profile *ThrottleProfile
+}
+
+func (p *pacingReader) Read(b []byte) (int, error) {
+	if p.profile.ChunkSize > 0 && len(b) > p.profile.ChunkSize {
+		b = b[:p.profile.ChunkSize]
+	}
+	delay := p.profile.Latency
+	if p.profile.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.profile.Jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return p.r.Read(b)
+}
+
+func (tp *ThrottleProfile) wrap(body io.ReadCloser) io.ReadCloser {
+	if tp == nil || body == nil {
+		return body
+	}
+	return readCloser{&pacingReader{body, tp}, body}
+}
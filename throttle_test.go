@@ -0,0 +1,46 @@
+package frogproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestResponseThrottle(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer up.Close()
+
+	cases := []struct {
+		name     string
+		profile  *frogproxy.ThrottleProfile
+		min, max time.Duration
+	}{
+		{"unthrottled", nil, 0, time.Second},
+		{"latency per chunk", &frogproxy.ThrottleProfile{ChunkSize: 100, Latency: 20 * time.Millisecond}, 200 * time.Millisecond, 2 * time.Second},
+		{"latency without chunking", &frogproxy.ThrottleProfile{Latency: 50 * time.Millisecond}, 50 * time.Millisecond, time.Second},
+		{"jitter only", &frogproxy.ThrottleProfile{ChunkSize: 100, Jitter: 10 * time.Millisecond}, 0, 2 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := frogproxy.NewProxyHttpServer()
+			p.ResponseThrottle = tc.profile
+			c := proxyClient(t, p)
+			start := time.Now()
+			_, got := get(t, c, up.URL)
+			elapsed := time.Since(start)
+			if got != body {
+				t.Fatalf("body = %d bytes, want %d", len(got), len(body))
+			}
+			if elapsed < tc.min || elapsed > tc.max {
+				t.Errorf("took %v, want between %v and %v", elapsed, tc.min, tc.max)
+			}
+		})
+	}
+}
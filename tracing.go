@@ -0,0 +1,65 @@
+package frogproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// TracerProvider is the seam used to emit spans without depending on a
+// tracing library. An OpenTelemetry adapter starts spans from a
+// trace.Tracer and injects headers with a propagation.TextMapPropagator.
+type TracerProvider interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+	Inject(ctx context.Context, header http.Header)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+func (proxy *ProxyHttpServer) SetTracerProvider(tp TracerProvider) {
+	proxy.tracer = tp
+}
+
+func (proxy *ProxyHttpServer) startSpan(ctx *ProxyCtx, req *http.Request, parent context.Context) {
+	if proxy.tracer == nil || req == nil {
+		return
+	}
+	if parent == nil {
+		parent = req.Context()
+	}
+	name := "HTTP " + req.Method
+	if req.Method == http.MethodConnect {
+		name = "CONNECT"
+	}
+	ctx.spanCtx, ctx.span = proxy.tracer.Start(parent, name)
+	ctx.span.SetAttribute("http.request.method", req.Method)
+	host := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	ctx.span.SetAttribute("server.address", host)
+}
+
+func (proxy *ProxyHttpServer) injectSpan(ctx *ProxyCtx, header http.Header) {
+	if proxy.tracer == nil || ctx.span == nil {
+		return
+	}
+	proxy.tracer.Inject(ctx.spanCtx, header)
+}
+
+func (ctx *ProxyCtx) endSpan(status int, size int64) {
+	if ctx.span == nil {
+		return
+	}
+	if status > 0 {
+		ctx.span.SetAttribute("http.response.status_code", status)
+	}
+	ctx.span.SetAttribute("http.response.body.size", size)
+	if ctx.Error != nil {
+		ctx.span.SetAttribute("error", ctx.Error.Error())
+	}
+	ctx.span.End()
+	ctx.span = nil
+}
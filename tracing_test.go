@@ -0,0 +1,121 @@
+package frogproxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/fj9140/frogproxy"
+)
+
+type spanKey struct{}
+
+// recorder is an in-memory TracerProvider.
+type recorder struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	r      *recorder
+	id     int
+	parent int
+	name   string
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (r *recorder) Start(ctx context.Context, name string) (context.Context, frogproxy.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &recordedSpan{r: r, id: len(r.spans) + 1, name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.id
+	}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (r *recorder) Inject(ctx context.Context, header http.Header) {
+	if s, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		header.Set("Traceparent", fmt.Sprintf("00-trace-%d-01", s.id))
+	}
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.ended = true
+}
+
+// ended returns a copy of the finished spans.
+func (r *recorder) ended() []recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []recordedSpan
+	for _, s := range r.spans {
+		if s.ended {
+			spans = append(spans, *s)
+		}
+	}
+	return spans
+}
+
+func TestTracerProvider(t *testing.T) {
+	traceparent := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+		io.WriteString(w, "traced")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	rec := &recorder{}
+	p := frogproxy.NewProxyHttpServer()
+	p.SetTracerProvider(rec)
+	c, _ := mitmClient(t, p)
+
+	get(t, c, plain.URL)
+	spans := rec.ended()
+	if len(spans) != 1 {
+		t.Fatalf("plain: %d spans ended, want 1", len(spans))
+	}
+	s := spans[0]
+	if s.name != "HTTP GET" || s.attrs["http.response.status_code"] != 200 || s.attrs["http.response.body.size"] != int64(len("traced")) {
+		t.Fatalf("plain: span %s %v", s.name, s.attrs)
+	}
+	if got, want := <-traceparent, fmt.Sprintf("00-trace-%d-01", s.id); got != want {
+		t.Fatalf("plain: upstream saw traceparent %q, want %q", got, want)
+	}
+
+	get(t, c, secure.URL)
+	tr := c.Transport.(*http.Transport)
+	tr.CloseIdleConnections()
+	eventually(t, func() bool { return len(rec.ended()) == 3 }, "tunnel span not ended")
+	var connect, inner recordedSpan
+	for _, s := range rec.ended()[1:] {
+		if s.name == "CONNECT" {
+			connect = s
+		} else {
+			inner = s
+		}
+	}
+	if connect.id == 0 || inner.name != "HTTP GET" || inner.parent != connect.id {
+		t.Fatalf("mitm: CONNECT span %d, inner span %q with parent %d", connect.id, inner.name, inner.parent)
+	}
+	if got, want := <-traceparent, fmt.Sprintf("00-trace-%d-01", inner.id); got != want {
+		t.Fatalf("mitm: upstream saw traceparent %q, want %q", got, want)
+	}
+}
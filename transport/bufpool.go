@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Request writes borrow a buffered writer only for as long as the write
+// takes, so idle connections don't each hold one.
+var bufioWriterPool sync.Pool
+
+func newBufioWriter(w io.Writer) *bufio.Writer {
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriter(w)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+var ErrDecompressionLimit = errors.New("transport: decompressed body exceeds limit")
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+type decompressionGuard struct {
+	io.ReadCloser
+	compressed *countingReader
+	maxBytes   int64
+	maxRatio   int64
+	n          int64
+}
+
+func (g *decompressionGuard) Read(p []byte) (n int, err error) {
+	n, err = g.ReadCloser.Read(p)
+	g.n += int64(n)
+	if g.maxBytes > 0 && g.n > g.maxBytes {
+		return 0, ErrDecompressionLimit
+	}
+	if g.maxRatio > 0 && g.compressed.n > 0 && g.n > g.compressed.n*g.maxRatio {
+		return 0, ErrDecompressionLimit
+	}
+	return
+}
+
+// NewDecodingReader decodes body according to a gzip, deflate or br
+// Content-Encoding. Reads fail with ErrDecompressionLimit once the decoded
+// size exceeds maxBytes, or maxRatio times the encoded bytes read so far;
+// a zero limit is not enforced. Closing the result does not close body.
+func NewDecodingReader(body io.Reader, encoding string, maxBytes int64, maxRatio int) (io.ReadCloser, error) {
+	compressed := &countingReader{r: body}
+	var decoded io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		decoded, err = gzip.NewReader(compressed)
+	case "deflate":
+		decoded, err = zlib.NewReader(compressed)
+	case "br":
+		decoded = io.NopCloser(brotli.NewReader(compressed))
+	default:
+		return nil, fmt.Errorf("transport: unsupported content encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 && maxRatio <= 0 {
+		return decoded, nil
+	}
+	return &decompressionGuard{
+		ReadCloser: decoded,
+		compressed: compressed,
+		maxBytes:   maxBytes,
+		maxRatio:   int64(maxRatio),
+	}, nil
+}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+type dnsEntry struct {
+	addr    *net.TCPAddr
+	expires time.Time
+}
+
+// resolveTCPAddr resolves addr, reusing a previous resolution for up to
+// DNSCacheTTL.
+func (t *Transport) resolveTCPAddr(addr string) (*net.TCPAddr, error) {
+	if t.DNSCacheTTL <= 0 {
+		return net.ResolveTCPAddr("tcp", addr)
+	}
+	now := time.Now()
+	t.lk.Lock()
+	if e, ok := t.dnsCache[addr]; ok {
+		if now.Before(e.expires) {
+			t.lk.Unlock()
+			return e.addr, nil
+		}
+		delete(t.dnsCache, addr)
+	}
+	t.lk.Unlock()
+
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.lk.Lock()
+	if t.dnsCache == nil {
+		t.dnsCache = make(map[string]dnsEntry)
+	}
+	for k, e := range t.dnsCache {
+		if !now.Before(e.expires) {
+			delete(t.dnsCache, k)
+		}
+	}
+	t.dnsCache[addr] = dnsEntry{resolved, now.Add(t.DNSCacheTTL)}
+	t.lk.Unlock()
+	return resolved, nil
+}
+
+// forgetTCPAddr drops a cached resolution, e.g. after dialing it failed.
+func (t *Transport) forgetTCPAddr(addr string) {
+	t.lk.Lock()
+	delete(t.dnsCache, addr)
+	t.lk.Unlock()
+}
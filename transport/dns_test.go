@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheTTL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	live := srv.Listener.Addr().(*net.TCPAddr)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	// cached.invalid never resolves, so reaching the origin through it
+	// shows the cached address was used.
+	const host = "cached.invalid:80"
+	for _, tt := range []struct {
+		name    string
+		ttl     time.Duration
+		entry   dnsEntry
+		ok      bool
+		evicted bool
+	}{
+		{"cache disabled", 0, dnsEntry{live, time.Now().Add(time.Minute)}, false, false},
+		{"fresh entry reused", time.Minute, dnsEntry{live, time.Now().Add(time.Minute)}, true, false},
+		{"stale entry dropped", time.Minute, dnsEntry{live, time.Now().Add(-time.Second)}, false, true},
+		{"failed dial forgets entry", time.Minute, dnsEntry{dead, time.Now().Add(time.Minute)}, false, true},
+	} {
+		tr := &Transport{DNSCacheTTL: tt.ttl, DisableKeepAlives: true}
+		tr.dnsCache = map[string]dnsEntry{host: tt.entry}
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		_, resp, err := tr.DetailedRoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: round trip error %v", tt.name, err)
+		}
+		if _, cached := tr.dnsCache[host]; cached == tt.evicted {
+			t.Errorf("%s: entry still cached = %v", tt.name, cached)
+		}
+	}
+
+	// A real resolution is cached for the TTL.
+	tr := &Transport{DNSCacheTTL: time.Minute, DisableKeepAlives: true}
+	before := time.Now()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp := roundTrip(t, tr, req)
+	resp.Body.Close()
+	e, ok := tr.dnsCache[live.String()]
+	if !ok || !e.addr.IP.Equal(live.IP) || e.expires.Before(before.Add(time.Minute)) || e.expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("cache after dialing %s: %+v", live, tr.dnsCache)
+	}
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func sockopt(t *testing.T, c net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tests := []struct {
+		keepAlive  time.Duration
+		customDial bool
+		enabled    bool
+		idle       int
+	}{
+		{0, false, true, 0}, // Go's own default applies
+		{-1, false, false, 0},
+		{45 * time.Second, false, true, 45},
+		{45 * time.Second, true, true, 45},
+		{-1, true, false, 0},
+	}
+	for _, tt := range tests {
+		tr := &Transport{KeepAlive: tt.keepAlive}
+		if tt.customDial {
+			// net.Dial turns keep-alive on by default.
+			tr.Dial = net.Dial
+		}
+		c, _, _, err := tr.dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		enabled := sockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		if enabled != tt.enabled {
+			t.Errorf("KeepAlive %v (custom dial %v): SO_KEEPALIVE = %v, want %v", tt.keepAlive, tt.customDial, enabled, tt.enabled)
+		}
+		if tt.idle > 0 {
+			if idle := sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != tt.idle {
+				t.Errorf("KeepAlive %v: TCP_KEEPIDLE = %d, want %d", tt.keepAlive, idle, tt.idle)
+			}
+		}
+		c.Close()
+	}
+}
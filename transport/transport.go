@@ -2,8 +2,9 @@ package transport
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -15,20 +16,75 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 var DefaultMaxIdleConnsPerHost = 2
 
+type writeTimeoutError struct {
+	err error
+}
+
+func (e *writeTimeoutError) Error() string {
+	return "transport: request write timeout: " + e.err.Error()
+}
+func (e *writeTimeoutError) Unwrap() error   { return e.err }
+func (e *writeTimeoutError) Timeout() bool   { return true }
+func (e *writeTimeoutError) Temporary() bool { return true }
+
 type Transport struct {
 	Proxy               func(*http.Request) (*url.URL, error)
 	lk                  sync.Mutex
 	altProto            map[string]RoundTripper
 	idleConn            map[string][]*persistConn
+	idleCount           int
+	tlsErrors           map[string]int
+	stats               TransportStats
+	dnsCache            map[string]dnsEntry
 	Dial                func(net, addr string) (c net.Conn, err error)
 	TLSClientConfig     *tls.Config
 	DisableCompression  bool
 	DisableKeepAlives   bool
 	MaxIdleConnsPerHost int
+	// MaxIdleConns caps idle connections across all hosts. Returning one
+	// more closes the connection that has been idle longest. Zero means
+	// no limit.
+	MaxIdleConns int
+
+	VerifyPeerCertificate func(rawCerts [][]byte, host string) error
+
+	MaxDecompressedBytes int64
+	MaxCompressionRatio  int
+
+	// ShouldDecompress, when set, replaces DisableCompression per request:
+	// returning false sends the request without an added Accept-Encoding
+	// and leaves the response body as the server encoded it.
+	ShouldDecompress func(req *http.Request) bool
+
+	// KeepAlive is the TCP keep-alive period of upstream connections. A
+	// negative value turns keep-alive probes off; zero keeps Go's default.
+	KeepAlive time.Duration
+
+	// IdleConnTimeout closes pooled connections left idle for longer,
+	// instead of reusing them. They are checked lazily, when a connection
+	// is taken from or returned to the pool. Zero means no limit.
+	IdleConnTimeout     time.Duration
+	RequestWriteTimeout time.Duration
+	// DNSCacheTTL reuses the resolved address of an upstream host for this
+	// long, instead of resolving it on every dial. A resolution is dropped
+	// early when dialing it fails. Zero disables the cache.
+	DNSCacheTTL time.Duration
+}
+
+// TransportStats counts how the idle connection pool has been used.
+type TransportStats struct {
+	// Dials is the number of new upstream connections opened.
+	Dials int64
+	// Reuses is the number of requests served on an idle connection.
+	Reuses int64
+	// Evictions is the number of connections closed by the pool: over a
+	// per-host or global idle limit, or idle past IdleConnTimeout.
+	Evictions int64
 }
 
 type RoundTripDetails struct {
@@ -47,6 +103,15 @@ type connectMethod struct {
 	proxyURL     *url.URL
 	targetSchema string
 	targetAddr   string
+	serverName   string
+}
+
+type serverNameKey struct{}
+
+// WithServerName makes requests carrying ctx send serverName as SNI and
+// verify the upstream certificate against it instead of the dialed host.
+func WithServerName(ctx context.Context, serverName string) context.Context {
+	return context.WithValue(ctx, serverNameKey{}, serverName)
 }
 
 type responseAndError struct {
@@ -65,7 +130,6 @@ type persistConn struct {
 	cacheKey             string
 	conn                 net.Conn
 	br                   *bufio.Reader
-	bw                   *bufio.Writer
 	reqch                chan requestAndChan
 	isProxy              bool
 	mutateHeaderFunc     func(http.Header)
@@ -74,6 +138,7 @@ type persistConn struct {
 	broken               bool
 	host                 string
 	ip                   *net.TCPAddr
+	idleAt               time.Time
 }
 
 type discardOnCloseReadCloser struct {
@@ -159,7 +224,7 @@ func (pc *persistConn) closeLocked() {
 }
 
 func (pc *persistConn) readLoop() {
-	alive := false
+	alive := true
 	var lastBody io.ReadCloser
 	for alive {
 		pb, err := pc.br.Peek(1)
@@ -187,16 +252,17 @@ func (pc *persistConn) readLoop() {
 			pc.close()
 		} else {
 			hasBody := rc.req.Method != "HEAD" && resp.ContentLength != 0
-			if rc.addedGzip && hasBody && resp.Header.Get("Content-Encoding") == "gzip" {
+			encoding := resp.Header.Get("Content-Encoding")
+			if rc.addedGzip && hasBody && (encoding == "gzip" || encoding == "deflate" || encoding == "br") {
 				resp.Header.Del("Content-Encoding")
 				resp.Header.Del("Content-Length")
 				resp.ContentLength = -1
-				gzReader, zerr := gzip.NewReader(resp.Body)
-				if zerr != nil {
+				var decoded io.ReadCloser
+				decoded, err = NewDecodingReader(resp.Body, encoding, pc.t.MaxDecompressedBytes, pc.t.MaxCompressionRatio)
+				if err != nil {
 					pc.close()
-					err = zerr
 				} else {
-					resp.Body = &readFirstCloseBoth{&discardOnCloseReadCloser{gzReader}, resp.Body}
+					resp.Body = &readFirstCloseBoth{&discardOnCloseReadCloser{decoded}, resp.Body}
 				}
 			}
 			resp.Body = &bodyEOFSignal{body: resp.Body}
@@ -239,26 +305,54 @@ func (pc *persistConn) roundTrip(req *transportRequest) (resp *http.Response, er
 		panic("mutateHeaderFunc not supported in modified Transport")
 	}
 
+	decompress := !pc.t.DisableCompression
+	if pc.t.ShouldDecompress != nil {
+		decompress = pc.t.ShouldDecompress(req.Request)
+	}
 	requestedGzip := false
-	if !pc.t.DisableCompression && req.Header.Get("Accept-Encoding") == "" {
+	if decompress && req.Header.Get("Accept-Encoding") == "" {
 		requestedGzip = true
-		req.extraHeaders().Set("Accept-Encoding", "gzip")
+		req.extraHeaders().Set("Accept-Encoding", "gzip, deflate, br")
 	}
 
 	pc.lk.Lock()
 	pc.numExpectedResponses++
 	pc.lk.Unlock()
 
+	var writeDeadline time.Time
+	if pc.t.RequestWriteTimeout > 0 {
+		writeDeadline = time.Now().Add(pc.t.RequestWriteTimeout)
+		pc.conn.SetWriteDeadline(writeDeadline)
+	}
+	outreq := req.Request
+	if len(req.extra) > 0 {
+		outreq = new(http.Request)
+		*outreq = *req.Request
+		outreq.Header = req.Header.Clone()
+		for k, vs := range req.extra {
+			outreq.Header[k] = vs
+		}
+	}
+	bw := newBufioWriter(pc.conn)
 	if pc.isProxy {
-		err = req.Request.WriteProxy(pc.bw)
+		err = outreq.WriteProxy(bw)
 	} else {
-		err = req.Request.Write(pc.bw)
+		err = outreq.Write(bw)
 	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	putBufioWriter(bw)
 	if err != nil {
 		pc.close()
+		if !writeDeadline.IsZero() && !time.Now().Before(writeDeadline) {
+			err = &writeTimeoutError{err}
+		}
 		return
 	}
-	pc.bw.Flush()
+	if pc.t.RequestWriteTimeout > 0 {
+		pc.conn.SetWriteDeadline(time.Time{})
+	}
 
 	ch := make(chan responseAndError, 1)
 	pc.reqch <- requestAndChan{req.Request, ch, requestedGzip}
@@ -275,10 +369,13 @@ func (cm *connectMethod) String() string {
 	if cm.proxyURL != nil {
 		proxyStr = cm.proxyURL.String()
 	}
-	return strings.Join([]string{proxyStr, cm.targetSchema, cm.targetAddr}, "|")
+	return strings.Join([]string{proxyStr, cm.targetSchema, cm.targetAddr, cm.serverName}, "|")
 }
 
 func (cm *connectMethod) tlsHost() string {
+	if cm.serverName != "" {
+		return cm.serverName
+	}
 	h := cm.targetAddr
 	if hasPort(h) {
 		h = h[:strings.LastIndex(h, ":")]
@@ -308,6 +405,9 @@ func (t *Transport) connectMethodForRequest(treq *transportRequest) (*connectMet
 		targetSchema: treq.URL.Scheme,
 		targetAddr:   canonicalAddr(treq.URL),
 	}
+	if name, ok := treq.Context().Value(serverNameKey{}).(string); ok {
+		cm.serverName = name
+	}
 	if t.Proxy != nil {
 		var err error
 		cm.proxyURL, err = t.Proxy(treq.Request)
@@ -337,32 +437,66 @@ func (t *Transport) getIdleConn(cm *connectMethod) (pconn *persistConn) {
 			pconn = pconns[len(pconns)-1]
 			t.idleConn[key] = pconns[0 : len(pconns)-1]
 		}
-		if !pconn.isBroken() {
-			return
+		t.idleCount--
+		if pconn.isBroken() {
+			continue
+		}
+		if t.idleExpired(pconn) {
+			pconn.close()
+			t.stats.Evictions++
+			continue
 		}
+		t.stats.Reuses++
+		return
 	}
 }
 
+func (t *Transport) idleExpired(pconn *persistConn) bool {
+	return t.IdleConnTimeout > 0 && time.Since(pconn.idleAt) > t.IdleConnTimeout
+}
+
 func (t *Transport) dial(network, addr string) (c net.Conn, raddr string, ip *net.TCPAddr, err error) {
 	if t.Dial != nil {
-		ip, err = net.ResolveTCPAddr("tcp", addr)
+		ip, err = t.resolveTCPAddr(addr)
 		if err != nil {
 			return
 		}
 		c, err = t.Dial(network, addr)
 		raddr = addr
+		if err == nil {
+			t.setKeepAlive(c)
+		}
+		return
+	}
+	addri, err := t.resolveTCPAddr(addr)
+	if err != nil {
 		return
 	}
-	addri, err := net.ResolveTCPAddr("tcp", addr)
+	tc, err := net.DialTCP("tcp", nil, addri)
 	if err != nil {
+		t.forgetTCPAddr(addr)
 		return
 	}
-	c, err = net.DialTCP("tcp", nil, addri)
+	c = tc
+	t.setKeepAlive(c)
 	raddr = addr
 	ip = addri
 	return
 }
 
+func (t *Transport) setKeepAlive(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok || t.KeepAlive == 0 {
+		return
+	}
+	if t.KeepAlive < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(t.KeepAlive)
+}
+
 func (t *Transport) putIdleConn(pconn *persistConn) bool {
 	t.lk.Lock()
 	defer t.lk.Unlock()
@@ -378,19 +512,119 @@ func (t *Transport) putIdleConn(pconn *persistConn) bool {
 	if max == 0 {
 		max = DefaultMaxIdleConnsPerHost
 	}
+	if t.IdleConnTimeout > 0 {
+		live := t.idleConn[key][:0]
+		for _, pc := range t.idleConn[key] {
+			if t.idleExpired(pc) {
+				pc.close()
+				t.idleCount--
+				t.stats.Evictions++
+				continue
+			}
+			live = append(live, pc)
+		}
+		if len(live) == 0 {
+			delete(t.idleConn, key)
+		} else {
+			t.idleConn[key] = live
+		}
+	}
 	if len(t.idleConn[key]) >= max {
 		pconn.close()
+		t.stats.Evictions++
 		return false
 	}
+	if t.MaxIdleConns > 0 && t.idleCount >= t.MaxIdleConns {
+		t.evictOldestIdleLocked()
+	}
+	pconn.idleAt = time.Now()
 	t.idleConn[key] = append(t.idleConn[key], pconn)
+	t.idleCount++
 	return true
 }
 
+func (t *Transport) evictOldestIdleLocked() {
+	var oldestKey string
+	oldest := -1
+	for key, pconns := range t.idleConn {
+		for i, pc := range pconns {
+			if oldest < 0 || pc.idleAt.Before(t.idleConn[oldestKey][oldest].idleAt) {
+				oldestKey, oldest = key, i
+			}
+		}
+	}
+	if oldest < 0 {
+		return
+	}
+	pconns := t.idleConn[oldestKey]
+	pconns[oldest].close()
+	t.stats.Evictions++
+	if len(pconns) == 1 {
+		delete(t.idleConn, oldestKey)
+	} else {
+		t.idleConn[oldestKey] = append(pconns[:oldest], pconns[oldest+1:]...)
+	}
+	t.idleCount--
+}
+
+func (t *Transport) CloseIdleConnections() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	for _, pconns := range t.idleConn {
+		for _, pconn := range pconns {
+			pconn.close()
+		}
+	}
+	t.idleConn = make(map[string][]*persistConn)
+	t.idleCount = 0
+}
+
+// Stats returns a snapshot of the pool counters.
+func (t *Transport) Stats() TransportStats {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.stats
+}
+
+func (t *Transport) IdleConnList() map[string]int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	counts := make(map[string]int, len(t.idleConn))
+	for key, pconns := range t.idleConn {
+		counts[key] = len(pconns)
+	}
+	return counts
+}
+
+func (t *Transport) recordTLSError(host string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.tlsErrors == nil {
+		t.tlsErrors = make(map[string]int)
+	}
+	t.tlsErrors[host]++
+}
+
+// TLSErrorStats returns how many TLS handshakes or hostname checks have
+// failed for each upstream host since the transport was created.
+func (t *Transport) TLSErrorStats() map[string]int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	stats := make(map[string]int, len(t.tlsErrors))
+	for host, n := range t.tlsErrors {
+		stats[host] = n
+	}
+	return stats
+}
+
 func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
 	if pc := t.getIdleConn(cm); pc != nil {
 		return pc, nil
 	}
 
+	t.lk.Lock()
+	t.stats.Dials++
+	t.lk.Unlock()
 	conn, raddr, ip, err := t.dial("tcp", cm.addr())
 	if err != nil {
 		if cm.proxyURL != nil {
@@ -444,23 +678,61 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
 	}
 
 	if cm.targetSchema == "https" {
-		conn = tls.Client(conn, t.TLSClientConfig)
+		cfg := t.tlsConfigFor(cm.tlsHost())
+		if cm.serverName != "" {
+			if cfg == nil {
+				cfg = &tls.Config{}
+			} else {
+				cfg = cfg.Clone()
+			}
+			cfg.ServerName = cm.serverName
+		}
+		conn = tls.Client(conn, cfg)
 		if err = conn.(*tls.Conn).Handshake(); err != nil {
+			t.recordTLSError(cm.tlsHost())
 			return nil, err
 		}
 		if t.TLSClientConfig == nil || !t.TLSClientConfig.InsecureSkipVerify {
-			if err = conn.(*tls.Conn).VerifyHostname(cm.tlsHost()); err != nil {
+			verifyHost := cm.tlsHost()
+			if cm.serverName != "" {
+				verifyHost = cm.serverName
+			}
+			if err = conn.(*tls.Conn).VerifyHostname(verifyHost); err != nil {
+				t.recordTLSError(cm.tlsHost())
 				return nil, err
 			}
 		}
 
+		pconn.conn = conn
 	}
 	pconn.br = bufio.NewReader(pconn.conn)
-	pconn.bw = bufio.NewWriter(pconn.conn)
 	go pconn.readLoop()
 	return pconn, nil
 }
 
+func (t *Transport) tlsConfigFor(host string) *tls.Config {
+	if t.VerifyPeerCertificate == nil {
+		return t.TLSClientConfig
+	}
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	verify := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+		return t.VerifyPeerCertificate(rawCerts, host)
+	}
+	return cfg
+}
+
 func (t *Transport) DetailedRoundTrip(req *http.Request) (details *RoundTripDetails, resp *http.Response, err error) {
 	if req.URL == nil {
 		return nil, nil, errors.New("http: nil Request.URL")
@@ -0,0 +1,617 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func roundTrip(t *testing.T, tr *Transport, req *http.Request) *http.Response {
+	t.Helper()
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		_, resp, err := tr.DetailedRoundTrip(req)
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("round trip did not complete")
+	}
+	return nil
+}
+
+func TestRoundTripCompletes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	tr := &Transport{}
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		resp := roundTrip(t, tr, req)
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "hello "+path {
+			t.Fatalf("got %q", b)
+		}
+	}
+}
+
+func TestConflictingContentLengthRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde")
+	}()
+
+	tr := &Transport{}
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	_, resp, err := tr.DetailedRoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("response with conflicting Content-Length was accepted")
+	}
+	if !strings.Contains(err.Error(), "Content-Length") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func compressed(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	bomb := bytes.Repeat([]byte{'a'}, 1<<20)
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		body := compressed(t, encoding, bomb)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+				t.Errorf("Accept-Encoding %q does not offer %s", r.Header.Get("Accept-Encoding"), encoding)
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(body)
+		}))
+
+		for _, tr := range []*Transport{{}, {MaxDecompressedBytes: 1 << 16}, {MaxCompressionRatio: 10}} {
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			resp := roundTrip(t, tr, req)
+			got, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("%s: Content-Encoding not removed", encoding)
+			}
+			limited := tr.MaxDecompressedBytes > 0 || tr.MaxCompressionRatio > 0
+			if limited && !errors.Is(err, ErrDecompressionLimit) {
+				t.Errorf("%s %+v: got %d bytes, err %v; want ErrDecompressionLimit", encoding, tr, len(got), err)
+			}
+			if !limited && (err != nil || !bytes.Equal(got, bomb)) {
+				t.Errorf("%s: got %d bytes, err %v", encoding, len(got), err)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestBrotliResponses(t *testing.T) {
+	plain := []byte(strings.Repeat("hello brotli ", 100))
+	body := compressed(t, "br", plain)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name           string
+		acceptEncoding string
+		tr             *Transport
+		want           []byte
+		encoding       string
+	}{
+		{"decoded when the transport asked", "", &Transport{}, plain, ""},
+		{"passed through when the client asked", "br", &Transport{}, body, "br"},
+		{"passed through when compression is off", "", &Transport{DisableCompression: true}, body, "br"},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		resp := roundTrip(t, tt.tr, req)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, err %v; want %d bytes", tt.name, len(got), err, len(tt.want))
+		}
+		if ce := resp.Header.Get("Content-Encoding"); ce != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, ce, tt.encoding)
+		}
+		if tt.encoding == "" && (resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1) {
+			t.Errorf("%s: compressed length kept: header %q, ContentLength %d", tt.name, resp.Header.Get("Content-Length"), resp.ContentLength)
+		}
+	}
+}
+
+func TestShouldDecompress(t *testing.T) {
+	plain := []byte(strings.Repeat("hello gzip ", 100))
+	body := compressed(t, "gzip", plain)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer srv.Close()
+	onlyDecoded := func(req *http.Request) bool { return req.URL.Path == "/decoded" }
+
+	for _, tt := range []struct {
+		disable bool
+		hook    func(*http.Request) bool
+		path    string
+		decoded bool
+	}{
+		{false, nil, "/", true},
+		{true, nil, "/", false},
+		{false, onlyDecoded, "/raw", false},
+		{false, onlyDecoded, "/decoded", true},
+		{true, onlyDecoded, "/decoded", true},
+	} {
+		tr := &Transport{DisableCompression: tt.disable, ShouldDecompress: tt.hook}
+		req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+		resp := roundTrip(t, tr, req)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+
+		want, ae := body, ""
+		if tt.decoded {
+			want, ae = plain, "gzip, deflate, br"
+		}
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("disable=%v hook=%v %s: got %d bytes, err %v; want %d bytes", tt.disable, tt.hook != nil, tt.path, len(got), err, len(want))
+		}
+		if sent := resp.Header.Get("X-Accept-Encoding"); sent != ae {
+			t.Errorf("disable=%v hook=%v %s: sent Accept-Encoding %q, want %q", tt.disable, tt.hook != nil, tt.path, sent, ae)
+		}
+	}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	for _, accept := range []bool{true, false} {
+		var gotHost string
+		tr := &Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			VerifyPeerCertificate: func(rawCerts [][]byte, host string) error {
+				gotHost = host
+				if len(rawCerts) == 0 {
+					t.Error("no certificates passed to the verifier")
+				}
+				if !accept {
+					return errors.New("rejected by test verifier")
+				}
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		_, resp, err := tr.DetailedRoundTrip(req)
+		if accept {
+			if err != nil {
+				t.Fatalf("accepting verifier: %v", err)
+			}
+			resp.Body.Close()
+		} else if err == nil || !strings.Contains(err.Error(), "rejected by test verifier") {
+			t.Fatalf("rejecting verifier: got %v", err)
+		}
+		if gotHost != "127.0.0.1" {
+			t.Errorf("verifier called with host %q", gotHost)
+		}
+	}
+}
+
+func TestTLSErrorStats(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	// The test certificate is issued for example.com.
+	for _, tt := range []struct {
+		name string
+		tr   *Transport
+		want map[string]int
+	}{
+		{"trusted", &Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}, map[string]int{}},
+		{"unknown authority", &Transport{TLSClientConfig: &tls.Config{ServerName: "example.com"}}, map[string]int{"127.0.0.1": 2}},
+		{"wrong name", &Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "other.example"}}, map[string]int{"127.0.0.1": 2}},
+		{"rejected by verifier", &Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			VerifyPeerCertificate: func(rawCerts [][]byte, host string) error {
+				return errors.New("pinned key mismatch")
+			},
+		}, map[string]int{"127.0.0.1": 2}},
+	} {
+		// Two attempts each, so failures are counted rather than flagged.
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			_, resp, err := tt.tr.DetailedRoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != (len(tt.want) > 0) {
+				t.Fatalf("%s: round trip error %v", tt.name, err)
+			}
+		}
+		tt.tr.CloseIdleConnections()
+		if got := tt.tr.TLSErrorStats(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: TLSErrorStats() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkBufioWriterChurn(b *testing.B) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bw := bufio.NewWriter(io.Discard)
+			bw.Write(request)
+			bw.Flush()
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bw := newBufioWriter(io.Discard)
+			bw.Write(request)
+			bw.Flush()
+			putBufioWriter(bw)
+		}
+	})
+}
+
+// idleFor sums IdleConnList entries whose cache key targets addr.
+func idleFor(tr *Transport, addr string) int {
+	n := 0
+	for key, count := range tr.IdleConnList() {
+		if strings.Contains(key, "|"+addr+"|") {
+			n += count
+		}
+	}
+	return n
+}
+
+func TestIdleConnList(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	tr := &Transport{}
+	get := func(u string) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		return roundTrip(t, tr, req)
+	}
+	drain := func(resp *http.Response) {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	waitIdle := func(addr string, want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for idleFor(tr, addr) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d idle conns, want %d (%v)", addr, idleFor(tr, addr), want, tr.IdleConnList())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Sequential keep-alive requests reuse a single connection.
+	for i := 0; i < 3; i++ {
+		drain(get(a.URL))
+		waitIdle(a.Listener.Addr().String(), 1)
+	}
+	// Two overlapping requests to b need two connections.
+	r1, r2 := get(b.URL), get(b.URL)
+	waitIdle(b.Listener.Addr().String(), 0)
+	drain(r1)
+	drain(r2)
+	waitIdle(b.Listener.Addr().String(), 2)
+	waitIdle(a.Listener.Addr().String(), 1)
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		idle    time.Duration
+		want    TransportStats
+	}{
+		{"no timeout", 0, 150 * time.Millisecond, TransportStats{Dials: 1, Reuses: 1}},
+		{"reused within timeout", time.Second, 0, TransportStats{Dials: 1, Reuses: 1}},
+		{"evicted after timeout", 50 * time.Millisecond, 150 * time.Millisecond, TransportStats{Dials: 2, Evictions: 1}},
+	} {
+		tr := &Transport{IdleConnTimeout: tt.timeout}
+		for i := 0; i < 2; i++ {
+			if i > 0 {
+				time.Sleep(tt.idle)
+			}
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			resp := roundTrip(t, tr, req)
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			deadline := time.Now().Add(time.Second)
+			for idleFor(tr, addr) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: connection never returned to the idle pool", tt.name)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		if got := tr.Stats(); got != tt.want {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, got, tt.want)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	var addrs []string
+	var urls []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+		addrs = append(addrs, srv.Listener.Addr().String())
+		urls = append(urls, srv.URL)
+	}
+
+	for _, tt := range []struct {
+		max       int
+		idle      []int
+		evictions int64
+	}{
+		{0, []int{1, 1, 1}, 0},
+		// The third host pushes out the connection idle longest.
+		{2, []int{0, 1, 1}, 1},
+		{1, []int{0, 0, 1}, 2},
+	} {
+		tr := &Transport{MaxIdleConns: tt.max}
+		for i, u := range urls {
+			req, _ := http.NewRequest("GET", u, nil)
+			resp := roundTrip(t, tr, req)
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			deadline := time.Now().Add(time.Second)
+			for idleFor(tr, addrs[i]) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("max %d: connection to %s never went idle", tt.max, addrs[i])
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		for i, want := range tt.idle {
+			if got := idleFor(tr, addrs[i]); got != want {
+				t.Errorf("max %d: %d idle conns to host %d, want %d", tt.max, got, i, want)
+			}
+		}
+		if got := tr.Stats().Evictions; got != tt.evictions {
+			t.Errorf("max %d: %d evictions, want %d", tt.max, got, tt.evictions)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestStats(t *testing.T) {
+	hold := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-hold
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	defer close(hold)
+
+	settle := func(cond func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	get := func(tr *Transport, path string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		resp := roundTrip(t, tr, req)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	for _, tt := range []struct {
+		name       string
+		tr         *Transport
+		concurrent bool
+		want       TransportStats
+	}{
+		{"keep-alive", &Transport{}, false, TransportStats{Dials: 1, Reuses: 2}},
+		{"keep-alives disabled", &Transport{DisableKeepAlives: true}, false, TransportStats{Dials: 3}},
+		// Three connections at once, but only one may be kept idle.
+		{"per-host limit", &Transport{MaxIdleConnsPerHost: 1}, true, TransportStats{Dials: 3, Evictions: 2}},
+	} {
+		if tt.concurrent {
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest("GET", srv.URL+"/hold", nil)
+					_, resp, err := tt.tr.DetailedRoundTrip(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					io.ReadAll(resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			settle(func() bool { return tt.tr.Stats().Dials == 3 })
+			for i := 0; i < 3; i++ {
+				hold <- struct{}{}
+			}
+			wg.Wait()
+		} else {
+			for i := 0; i < 3; i++ {
+				get(tt.tr, "/")
+				// Wait for the connection to be back in the pool.
+				settle(func() bool { return tt.tr.DisableKeepAlives || len(tt.tr.IdleConnList()) == 1 })
+			}
+		}
+		settle(func() bool { return tt.tr.Stats() == tt.want })
+		if got := tt.tr.Stats(); got != tt.want {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, got, tt.want)
+		}
+		tt.tr.CloseIdleConnections()
+	}
+}
+
+func TestRequestWriteTimeout(t *testing.T) {
+	// An upstream that accepts but never reads, so the socket buffers fill.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			stalled <- c
+		}
+	}()
+	defer func() {
+		select {
+		case c := <-stalled:
+			c.Close()
+		default:
+		}
+	}()
+
+	tr := &Transport{RequestWriteTimeout: 100 * time.Millisecond}
+	body := make([]byte, 64<<20)
+	req, _ := http.NewRequest("POST", "http://"+l.Addr().String()+"/", bytes.NewReader(body))
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := tr.DetailedRoundTrip(req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("got %v, want a write timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request write was not bounded")
+	}
+}
+
+func TestServerNameOverride(t *testing.T) {
+	var gotSNI string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSNI = r.TLS.ServerName
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tr := &Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	// The test certificate is issued for example.com, not localhost.
+	target := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	req, _ := http.NewRequest("GET", target, nil)
+	if _, _, err := tr.DetailedRoundTrip(req); err == nil {
+		t.Fatal("request without override verified a certificate for another name")
+	}
+
+	req, _ = http.NewRequestWithContext(WithServerName(context.Background(), "example.com"), "GET", target, nil)
+	_, resp, err := tr.DetailedRoundTrip(req)
+	if err != nil {
+		t.Fatalf("request with override: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body %q", body)
+	}
+	if gotSNI != "example.com" {
+		t.Errorf("upstream saw SNI %q, want example.com", gotSNI)
+	}
+}
@@ -0,0 +1,61 @@
+package frogproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var errTunnelQuotaExceeded = errors.New("tunnel byte limit exceeded")
+
+type tunnelQuota struct {
+	used  int64
+	max   int64
+	once  sync.Once
+	conns []net.Conn
+}
+
+func (q *tunnelQuota) add(n int) bool {
+	if atomic.AddInt64(&q.used, int64(n)) <= q.max {
+		return true
+	}
+	q.once.Do(func() {
+		for _, c := range q.conns {
+			c.Close()
+		}
+	})
+	return false
+}
+
+type countingConn struct {
+	net.Conn
+	quota *tunnelQuota
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.quota.add(n) {
+		return 0, errTunnelQuotaExceeded
+	}
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfClosable); ok {
+		return hc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *countingConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfClosable); ok {
+		return hc.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+func limitTunnel(max int64, a, b net.Conn) (net.Conn, net.Conn) {
+	q := &tunnelQuota{max: max, conns: []net.Conn{a, b}}
+	return &countingConn{a, q}, &countingConn{b, q}
+}
@@ -0,0 +1,166 @@
+package frogproxy_test
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+// echoServer accepts TCP connections and echoes everything back.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMaxTunnelBytes(t *testing.T) {
+	target := echoServer(t)
+	p := frogproxy.NewProxyHttpServer()
+	p.MaxTunnelBytes = 100
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	// 5 bytes each way stays under the cap.
+	conn, _ := connectThrough(t, ps.URL, target)
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("under cap: got %q, %v", buf, err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if rest, err := io.ReadAll(conn); err != nil || len(rest) != 0 {
+		t.Fatalf("under cap: tunnel did not finish cleanly: %q, %v", rest, err)
+	}
+
+	// 200 bytes blows through it and the tunnel is torn down.
+	conn, _ = connectThrough(t, ps.URL, target)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(conn, strings.Repeat("x", 200))
+	n, err := io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("over cap: tunnel was not closed")
+	}
+	if n >= 200 {
+		t.Fatalf("over cap: %d bytes echoed through a 100 byte tunnel", n)
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Answer only once the client has finished sending, and keep
+		// going for a while after its FIN.
+		req, _ := io.ReadAll(c)
+		for i := 0; i < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			io.WriteString(c, "reply to "+string(req)+";")
+		}
+	}()
+
+	p := frogproxy.NewProxyHttpServer()
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	conn, _ := connectThrough(t, ps.URL, l.Addr().String())
+	io.WriteString(conn, "ping")
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if want := strings.Repeat("reply to ping;", 3); err != nil || string(b) != want {
+		t.Fatalf("got %q, %v; want %q", b, err, want)
+	}
+}
+
+func TestOnTunnelClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target := l.Addr().String()
+	// The origin reads a 10 byte request, answers with 25 bytes and, unless
+	// the client is to hang up first, closes.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 10)
+				io.ReadFull(c, buf)
+				io.WriteString(c, strings.Repeat("r", 25))
+				if string(buf) == "hold-open!" {
+					io.Copy(io.Discard, c)
+				}
+			}()
+		}
+	}()
+
+	type tunnelStats struct {
+		host           string
+		sent, received int64
+		dur            time.Duration
+	}
+	closed := make(chan tunnelStats, 1)
+	p := frogproxy.NewProxyHttpServer()
+	p.OnTunnelClose = func(host string, ctx *frogproxy.ProxyCtx, sent, received int64, dur time.Duration) {
+		closed <- tunnelStats{host, sent, received, dur}
+	}
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	for _, request := range []string{"close-now!", "hold-open!"} {
+		conn, _ := connectThrough(t, ps.URL, target)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, request)
+		buf := make([]byte, 25)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+
+		select {
+		case got := <-closed:
+			if got.host != target || got.sent != 10 || got.received != 25 || got.dur < 20*time.Millisecond {
+				t.Errorf("%s: OnTunnelClose(%s, sent %d, received %d, %v), want (%s, 10, 25, >=20ms)",
+					request, got.host, got.sent, got.received, got.dur, target)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: OnTunnelClose not called", request)
+		}
+	}
+}
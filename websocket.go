@@ -0,0 +1,87 @@
+package frogproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+func isWebSocketUpgrade(h http.Header) bool {
+	if !strings.EqualFold(h.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writableBody is a response body wrapper that still reaches the upgraded
+// connection underneath for writes.
+type writableBody struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (b *writableBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// keepWritable returns body, writable whenever orig was. The body of a 101
+// response is the upgraded connection, and tunnelUpgrade has to write to
+// it through whatever wrapper a response handler added.
+func keepWritable(orig, body io.ReadCloser) io.ReadCloser {
+	if _, ok := body.(io.Writer); ok {
+		return body
+	}
+	w, ok := orig.(io.Writer)
+	if !ok {
+		return body
+	}
+	return &writableBody{body, w}
+}
+
+func (proxy *ProxyHttpServer) tunnelUpgrade(ctx *ProxyCtx, client io.WriteCloser, clientReader io.Reader, resp *http.Response) int64 {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		ctx.Warnf("Upstream switched protocols without a writable connection")
+		httpError(client, ctx, errors.New("upstream switched protocols without a writable connection"))
+		return 0
+	}
+	defer upstream.Close()
+
+	if _, err := io.WriteString(client, statusLine(resp)); err != nil {
+		ctx.Warnf("Cannot write switching protocols status to client: %v", err)
+		return 0
+	}
+	if err := resp.Header.Write(client); err != nil {
+		ctx.Warnf("Cannot write switching protocols header to client: %v", err)
+		return 0
+	}
+	if _, err := io.WriteString(client, "\r\n"); err != nil {
+		ctx.Warnf("Cannot write switching protocols header to client: %v", err)
+		return 0
+	}
+	ctx.Logf("Switched protocols to %s, tunneling", resp.Header.Get("Upgrade"))
+
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		copyOrWarn(ctx, upstream, clientReader, &wg, &sent)
+		upstream.Close()
+	}()
+	go func() {
+		copyOrWarn(ctx, client, upstream, &wg, &received)
+		client.Close()
+	}()
+	wg.Wait()
+	return sent + received
+}
@@ -0,0 +1,71 @@
+package frogproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fj9140/frogproxy"
+)
+
+func TestMitmWebSocketEcho(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "not an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+	defer up.Close()
+	host := strings.TrimPrefix(up.URL, "https://")
+
+	logs := &logBuffer{}
+	p := frogproxy.NewProxyHttpServer()
+	p.BodyReadTimeout = 50 * time.Millisecond
+	p.LogRequests(logs)
+	p.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	p.OnRequest().HandleConnect(frogproxy.AlwaysMitm)
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	raw, _ := connectThrough(t, ps.URL, host)
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+host+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d, want 101", resp.StatusCode)
+	}
+
+	echo := func(msg string) {
+		t.Helper()
+		io.WriteString(conn, msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo %q: got %q, %v", msg, buf, err)
+		}
+	}
+	echo("ping")
+	// Idle for longer than BodyReadTimeout; the tunnel must survive.
+	time.Sleep(150 * time.Millisecond)
+	echo("pong")
+
+	conn.Close()
+	eventually(t, func() bool { return strings.Contains(logs.String(), "status=101") }, "upgrade not logged")
+}